@@ -0,0 +1,53 @@
+package purell
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cache is a concurrency-safe LRU cache of normalized URLs.
+type cache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key, value string
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *cache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+func (c *cache) add(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*cacheEntry).value = value
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key, value})
+	if c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
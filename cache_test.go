@@ -0,0 +1,27 @@
+package purell
+
+import (
+	"testing"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(2)
+	c.add("a", "A")
+	c.add("b", "B")
+	if v, ok := c.get("a"); !ok || v != "A" {
+		t.Errorf("get(%q): expected %q, true; got %q, %v", "a", "A", v, ok)
+	}
+	// "b" is now the least recently used entry.
+	c.add("c", "C")
+	if _, ok := c.get("b"); ok {
+		t.Errorf("get(%q): expected entry to have been evicted", "b")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("get(%q): expected entry to be present", k)
+		}
+	}
+	if n := c.ll.Len(); n != 2 {
+		t.Errorf("expected 2 entries; got %d", n)
+	}
+}
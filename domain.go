@@ -0,0 +1,24 @@
+package purell
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// RegistrableDomain returns the registrable domain of host, that is
+// its public suffix plus one label, as defined by the public suffix
+// list (a.b.example.co.uk -> example.co.uk). A port, if any, is
+// ignored, and IP addresses are returned unchanged, but for the
+// brackets of IPv6 literals. An error is
+// returned when host is itself a public suffix.
+func RegistrableDomain(host string) (string, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := strings.Trim(host, "[]"); net.ParseIP(ip) != nil {
+		return ip, nil
+	}
+	return publicsuffix.EffectiveTLDPlusOne(strings.ToLower(strings.TrimSuffix(host, ".")))
+}
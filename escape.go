@@ -0,0 +1,281 @@
+package purell
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const upperhex = "0123456789ABCDEF"
+
+// isUnreserved reports whether c is an unreserved character
+// as defined by RFC 3986, section 2.3.
+func isUnreserved(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '.', c == '_', c == '~':
+		return true
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved
+// characters in s, leaving all other escapes untouched.
+func decodeUnreserved(s string) string {
+	return decodeEscapes(s, isUnreserved)
+}
+
+// decodeEscapes decodes the percent-encoded characters c
+// in s for which decode(c) is true.
+func decodeEscapes(s string, decode func(c byte) bool) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			if c := unhex(s[i+1])<<4 | unhex(s[i+2]); decode(c) {
+				buf = append(buf, c)
+				i += 2
+				continue
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// removeEscapedFormatCharacters removes the percent-encoded
+// format characters (Unicode category Cf) from s.
+func removeEscapedFormatCharacters(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if r, n := decodeEscapedRune(s[i:]); n > 0 && unicode.Is(unicode.Cf, r) {
+			i += n - 1
+			continue
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// decodeEscapedRune decodes the percent-encoded UTF-8 sequence
+// at the start of s. It returns the rune and the length of its
+// escaped form, which is zero if s does not start with one.
+func decodeEscapedRune(s string) (rune, int) {
+	var b []byte
+	for i := 0; len(b) < utf8.UTFMax && i+2 < len(s) && s[i] == '%' && isHex(s[i+1]) && isHex(s[i+2]); i += 3 {
+		b = append(b, unhex(s[i+1])<<4|unhex(s[i+2]))
+		if utf8.FullRune(b) {
+			r, size := utf8.DecodeRune(b)
+			if r == utf8.RuneError && size <= 1 {
+				return 0, 0
+			}
+			return r, len(b) * 3
+		}
+	}
+	return 0, 0
+}
+
+// trimEscapedSpace returns s without its leading and trailing
+// white space, whether literal or percent-encoded.
+func trimEscapedSpace(s string) string {
+	for {
+		t := strings.TrimSpace(s)
+		for _, esc := range []string{"%20", "%09", "%0A", "%0D", "%0a", "%0d"} {
+			t = strings.TrimPrefix(t, esc)
+			t = strings.TrimSuffix(t, esc)
+		}
+		if t == s {
+			return s
+		}
+		s = t
+	}
+}
+
+// checkEscapes returns an error if s holds an invalid
+// percent-encoded triplet.
+func checkEscapes(s string) error {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			e := s[i:]
+			if len(e) > 3 {
+				e = e[:3]
+			}
+			return url.EscapeError(e)
+		}
+		i += 2
+	}
+	return nil
+}
+
+// collapseDoubleEncoding returns s with its escaped escapes, such
+// as %2520, decoded once (%20), provided that all the %25 escapes
+// of s are followed by two hexadecimal digits. Otherwise, s is
+// returned unchanged.
+func collapseDoubleEncoding(s string) string {
+	if !strings.Contains(s, "%25") {
+		return s
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || s[i+1] != '2' || s[i+2] != '5' {
+			continue
+		}
+		if i+4 >= len(s) || !isHex(s[i+3]) || !isHex(s[i+4]) {
+			return s
+		}
+	}
+	return decodeEscapes(s, func(c byte) bool { return c == '%' })
+}
+
+// uppercaseEscapesString returns s with the hexadecimal digits
+// of all its escapes in upper case.
+func uppercaseEscapesString(s string) string {
+	return mapEscapes(s, upper)
+}
+
+// lowercaseEscapesString returns s with the hexadecimal digits
+// of all its escapes in lower case.
+func lowercaseEscapesString(s string) string {
+	return mapEscapes(s, lower)
+}
+
+// mapEscapes returns s with f applied to the hexadecimal
+// digits of all its escapes.
+func mapEscapes(s string, f func(byte) byte) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	buf := []byte(s)
+	for i := 0; i+2 < len(buf); i++ {
+		if buf[i] == '%' && isHex(buf[i+1]) && isHex(buf[i+2]) {
+			buf[i+1] = f(buf[i+1])
+			buf[i+2] = f(buf[i+2])
+			i += 2
+		}
+	}
+	return string(buf)
+}
+
+func upper(c byte) byte {
+	if 'a' <= c && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c - 'A' + 'a'
+	}
+	return c
+}
+
+// mapEscaped replaces the escaped path, query and fragment
+// of u by the result of applying f to them.
+func mapEscaped(u *url.URL, f func(string) string) {
+	for _, c := range []Component{ComponentPath, ComponentQuery, ComponentFragment} {
+		mapEscapedComponent(u, c, f)
+	}
+}
+
+// mapEscapedComponent replaces the escaped form of the given
+// component of u by the result of applying f to it. The path
+// of opaque URLs is left untouched.
+func mapEscapedComponent(u *url.URL, c Component, f func(string) string) {
+	switch c {
+	case ComponentPath:
+		if len(u.Opaque) == 0 {
+			setEscapedPath(u, f(u.EscapedPath()))
+		}
+	case ComponentQuery:
+		u.RawQuery = f(u.RawQuery)
+	case ComponentFragment:
+		setEscapedFragment(u, f(u.EscapedFragment()))
+	}
+}
+
+// isSchemePrefix reports whether s is a scheme followed by a
+// colon, as defined by RFC 3986, section 3.1.
+func isSchemePrefix(s string) bool {
+	if len(s) < 2 || s[len(s)-1] != ':' {
+		return false
+	}
+	for i := 0; i < len(s)-1; i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9', c == '+', c == '-', c == '.':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setEscapedPath sets the path of u from its escaped form p,
+// preserving the given encoding when the url package allows it.
+func setEscapedPath(u *url.URL, p string) {
+	if path, err := url.PathUnescape(p); err == nil {
+		u.Path, u.RawPath = path, p
+	}
+}
+
+// setEscapedFragment sets the fragment of u from its escaped
+// form frag, preserving the given encoding when the url package
+// allows it.
+func setEscapedFragment(u *url.URL, frag string) {
+	if fragment, err := url.PathUnescape(frag); err == nil {
+		u.Fragment, u.RawFragment = fragment, frag
+	}
+}
+
+// decodeHostEscapes decodes the percent-encoded unreserved
+// characters in the host of the raw URL s. The authority must
+// start s or immediately follow its scheme, so that a // inside
+// an opaque URL is not taken for one.
+func decodeHostEscapes(s string) string {
+	i := strings.Index(s, "//")
+	if i < 0 || i > 0 && !isSchemePrefix(s[:i]) {
+		return s
+	}
+	start, end := i+2, len(s)
+	if j := strings.IndexAny(s[start:], "/?#"); j >= 0 {
+		end = start + j
+	}
+	if j := strings.LastIndex(s[start:end], "@"); j >= 0 {
+		start += j + 1
+	}
+	host := s[start:end]
+	if strings.HasPrefix(host, "[") {
+		// Leave the zone of IPv6 literals alone.
+		return s
+	}
+	return s[:start] + decodeUnreserved(host) + s[end:]
+}
@@ -8,7 +8,7 @@ import (
 
 func ExampleNormalizeURLString() {
 	if normalized, err := purell.NormalizeURLString("hTTp://someWEBsite.com:80/Amazing%3f/url/",
-		purell.LowercaseScheme|purell.LowercaseHost|purell.UppercaseEscapes); err != nil {
+		purell.FlagLowercaseScheme|purell.FlagLowercaseHost|purell.FlagUppercaseEscapes); err != nil {
 		panic(err)
 	} else {
 		fmt.Print(normalized)
@@ -18,7 +18,7 @@ func ExampleNormalizeURLString() {
 
 func ExampleMustNormalizeURLString() {
 	normalized := purell.MustNormalizeURLString("hTTpS://someWEBsite.com:80/Amazing%fa/url/",
-		purell.sUnsafe)
+		purell.FlagsUnsafe)
 	fmt.Print(normalized)
 
 	// Output: http://somewebsite.com/Amazing%FA/url
@@ -29,7 +29,7 @@ func ExampleNormalizeURL() {
 	if err != nil {
 		panic(err)
 	}
-	NormalizeURL(u, purell.UsuallySafe|purell.RemoveDuplicateSlashes|purell.RemoveFragment)
+	purell.NormalizeURL(u, purell.FlagsUsuallySafe|purell.FlagRemoveDuplicateSlashes|purell.FlagRemoveFragment)
 	fmt.Print(u)
 
 	// Output: http://someurl.com:8080/a/c/g?c=3&a=1&b=9&c=0
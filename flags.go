@@ -0,0 +1,128 @@
+package purell
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SafetyTier classifies normalizations by how likely they are
+// to make distinct resources compare equal.
+type SafetyTier int
+
+const (
+	// TierSafe normalizations never change the resource
+	// a URL refers to.
+	TierSafe SafetyTier = iota
+
+	// TierUsuallySafe normalizations change it only for
+	// unusual servers.
+	TierUsuallySafe
+
+	// TierUnsafe normalizations may change it.
+	TierUnsafe
+)
+
+// FlagInfo describes a single normalization flag.
+type FlagInfo struct {
+	// Name holds the name of the flag constant.
+	Name string
+
+	// Bit holds the flag itself.
+	Bit NormalizationFlags
+
+	// SafetyTier holds the safety tier of the normalization.
+	SafetyTier SafetyTier
+
+	// Description holds a short description of the normalization.
+	Description string
+}
+
+var flagInfos = []FlagInfo{
+	{"FlagLowercaseScheme", FlagLowercaseScheme, TierSafe, "Lowercase the scheme"},
+	{"FlagLowercaseHost", FlagLowercaseHost, TierSafe, "Lowercase the host"},
+	{"FlagUppercaseEscapes", FlagUppercaseEscapes, TierSafe, "Uppercase the hexadecimal digits of escapes"},
+	{"FlagDecodeUnnecessaryEscapes", FlagDecodeUnnecessaryEscapes, TierSafe, "Decode escaped unreserved characters"},
+	{"FlagRemoveDefaultPort", FlagRemoveDefaultPort, TierSafe, "Remove the default port of the scheme"},
+	{"FlagRemoveEmptyQuerySeparator", FlagRemoveEmptyQuerySeparator, TierSafe, "Remove a ? followed by an empty query"},
+	{"FlagRemoveTrailingSlash", FlagRemoveTrailingSlash, TierUsuallySafe, "Remove the trailing slash of the path"},
+	{"FlagAddTrailingSlash", FlagAddTrailingSlash, TierUsuallySafe, "Add a trailing slash to the path"},
+	{"FlagRemoveDotSegments", FlagRemoveDotSegments, TierUsuallySafe, "Remove the . and .. segments of the path"},
+	{"FlagRemoveDirectoryIndex", FlagRemoveDirectoryIndex, TierUnsafe, "Remove directory index files such as index.html"},
+	{"FlagRemoveFragment", FlagRemoveFragment, TierUnsafe, "Remove the fragment"},
+	{"FlagForceHttp", FlagForceHttp, TierUnsafe, "Replace the https scheme by http"},
+	{"FlagRemoveDuplicateSlashes", FlagRemoveDuplicateSlashes, TierUnsafe, "Collapse consecutive slashes in the path"},
+	{"FlagRemoveWWW", FlagRemoveWWW, TierUnsafe, "Remove the www. prefix of the host"},
+	{"FlagAddWWW", FlagAddWWW, TierUnsafe, "Add a www. prefix to the host"},
+	{"FlagSortQuery", FlagSortQuery, TierUnsafe, "Sort the query parameters"},
+	{"FlagNormalizeEmptyAuthority", FlagNormalizeEmptyAuthority, TierUnsafe, "Take the host of http URLs with an empty authority from the path"},
+	{"FlagCollapseHostDots", FlagCollapseHostDots, TierUnsafe, "Collapse consecutive dots in the host"},
+	{"FlagLowercaseHostASCII", FlagLowercaseHostASCII, TierSafe, "Lowercase the ASCII letters of the host"},
+	{"FlagRemoveRedundantQuestionMarkAndAmpersand", FlagRemoveRedundantQuestionMarkAndAmpersand, TierUnsafe, "Treat ? in the query as & and remove empty separators"},
+	{"FlagCanonicalizeBlankPathWithQuery", FlagCanonicalizeBlankPathWithQuery, TierUnsafe, "Add a / path to URLs with a host and a query"},
+	{"FlagSortMatrixParams", FlagSortMatrixParams, TierUnsafe, "Sort and deduplicate the matrix parameters of path segments"},
+	{"FlagEncodeQuerySpacesAsPlus", FlagEncodeQuerySpacesAsPlus, TierUnsafe, "Encode spaces in the query as +"},
+	{"FlagRemoveDuplicateQueryKeysKeepLast", FlagRemoveDuplicateQueryKeysKeepLast, TierUnsafe, "Keep only the last value of repeated query keys"},
+	{"FlagDecodePercentEncodedDotSegments", FlagDecodePercentEncodedDotSegments, TierUnsafe, "Decode escaped dots and slashes in the path"},
+	{"FlagLowercaseEscapes", FlagLowercaseEscapes, TierSafe, "Lowercase the hexadecimal digits of escapes"},
+	{"FlagNormalizeMailto", FlagNormalizeMailto, TierUnsafe, "Trim and lowercase the domain of mailto addresses"},
+	{"FlagRemoveFragmentDirectives", FlagRemoveFragmentDirectives, TierUnsafe, "Remove the :~: directives of the fragment"},
+	{"FlagNormalizeDataURIMediaType", FlagNormalizeDataURIMediaType, TierUnsafe, "Canonicalize the media type of data URLs"},
+	{"FlagCanonicalizeQuery", FlagCanonicalizeQuery, TierUnsafe, "Decode, re-encode, sort and deduplicate the query parameters"},
+	{"FlagCollapseConsecutiveAmpersands", FlagCollapseConsecutiveAmpersands, TierUnsafe, "Collapse consecutive & separators in the query"},
+	{"FlagNormalizeWindowsDriveLetter", FlagNormalizeWindowsDriveLetter, TierUnsafe, "Canonicalize the drive letter of file URLs"},
+	{"FlagNormalizeNestedOrigin", FlagNormalizeNestedOrigin, TierUnsafe, "Normalize the origin embedded in blob and filesystem URLs"},
+	{"FlagRemoveZeroWidthCharacters", FlagRemoveZeroWidthCharacters, TierUnsafe, "Remove invisible format characters from the host and path"},
+	{"FlagSortQueryArrayIndices", FlagSortQueryArrayIndices, TierUnsafe, "Sort the query parameters, ordering array indices numerically"},
+	{"FlagDecodeTrailingEncodedSlash", FlagDecodeTrailingEncodedSlash, TierUnsafe, "Decode a trailing escaped slash of the path"},
+	{"FlagRemoveUserInfo", FlagRemoveUserInfo, TierUnsafe, "Remove the user information"},
+	{"FlagRemovePort", FlagRemovePort, TierUnsafe, "Remove the port, whether it is the default one or not"},
+	{"FlagNormalizeQuerySemicolonToAmpersand", FlagNormalizeQuerySemicolonToAmpersand, TierUnsafe, "Rewrite ; query separators to &"},
+	{"FlagRemoveEmptyFragmentSeparator", FlagRemoveEmptyFragmentSeparator, TierSafe, "Remove a # followed by an empty fragment"},
+	{"FlagNormalizeURN", FlagNormalizeURN, TierSafe, "Lowercase the scheme and namespace identifier of urn URIs"},
+	{"FlagRemoveSchemeSeparatorSpaces", FlagRemoveSchemeSeparatorSpaces, TierUnsafe, "Remove the whitespace inside the scheme and around ://"},
+	{"FlagDecodeQueryThenReencodeCanonical", FlagDecodeQueryThenReencodeCanonical, TierUnsafe, "Decode the query keys and values and re-encode them minimally"},
+	{"FlagRemoveRedundantEncodedUnreservedInFragment", FlagRemoveRedundantEncodedUnreservedInFragment, TierSafe, "Decode percent-encoded unreserved characters in the fragment only"},
+	{"FlagCanonicalizeIPv4MappedIPv6", FlagCanonicalizeIPv4MappedIPv6, TierUnsafe, "Convert IPv4-mapped IPv6 hosts to dotted-decimal IPv4"},
+	{"FlagEncodeHostPunycode", FlagEncodeHostPunycode, TierUnsafe, "Convert Unicode hosts to their IDNA punycode form"},
+	{"FlagSortQueryPreserveFirstKeyPosition", FlagSortQueryPreserveFirstKeyPosition, TierUnsafe, "Sort the query values of each key, keeping keys in order of appearance"},
+	{"FlagRemoveTrackingParams", FlagRemoveTrackingParams, TierUnsafe, "Remove the common tracking query parameters"},
+	{"FlagNormalizeTrailingDotInPathSegments", FlagNormalizeTrailingDotInPathSegments, TierUnsafe, "Strip the trailing dots of path segments"},
+	{"FlagRemoveSessionIDParams", FlagRemoveSessionIDParams, TierUnsafe, "Remove session identifiers from the query and the path parameters"},
+	{"FlagForceWSS", FlagForceWSS, TierUnsafe, "Force the wss scheme for ws URLs"},
+	{"FlagLowercaseQueryEscapes", FlagLowercaseQueryEscapes, TierSafe, "Lowercase the hexadecimal digits of the query escapes"},
+	{"FlagRemoveDefaultPortOnForce", FlagRemoveDefaultPortOnForce, TierUnsafe, "Remove the default port of the scheme replaced by FlagForceHttp or FlagForceWSS"},
+	{"FlagTrimQueryValueSpaces", FlagTrimQueryValueSpaces, TierUnsafe, "Trim the white space around query values"},
+	{"FlagRemoveEmptyQueryPairs", FlagRemoveEmptyQueryPairs, TierUnsafe, "Remove the query pairs with neither key nor value"},
+	{"FlagNormalizeUnicodeHostNFC", FlagNormalizeUnicodeHostNFC, TierSafe, "Normalize the non-ASCII hosts to Unicode NFC"},
+	{"FlagSortQueryNestedKeys", FlagSortQueryNestedKeys, TierUnsafe, "Sort the query parameters by their nested bracket keys"},
+	{"FlagNormalizeViewSource", FlagNormalizeViewSource, TierSafe, "Normalize the URL inside view-source: URLs"},
+	{"FlagRemoveViewSource", FlagRemoveViewSource, TierUnsafe, "Remove the view-source: prefix of URLs"},
+	{"FlagRemoveTrailingQueryAmpersands", FlagRemoveTrailingQueryAmpersands, TierUnsafe, "Remove the trailing & separators of the query"},
+}
+
+// AllFlags returns information on all the individual normalization
+// flags, in increasing bit order. Flag groups such as FlagsSafe are
+// not included.
+func AllFlags() []FlagInfo {
+	return append([]FlagInfo(nil), flagInfos...)
+}
+
+// String returns the names of the individual flags set in f,
+// separated by "|", such as "FlagLowercaseScheme|FlagLowercaseHost".
+// Unknown bits are printed in hexadecimal, and no flags as "FlagNone".
+func (f NormalizationFlags) String() string {
+	if f == FlagNone {
+		return "FlagNone"
+	}
+	var names []string
+	for _, info := range flagInfos {
+		if f&info.Bit != 0 {
+			names = append(names, info.Name)
+			f &^= info.Bit
+		}
+	}
+	if f != 0 {
+		names = append(names, "0x"+strconv.FormatUint(uint64(f), 16))
+	}
+	return strings.Join(names, "|")
+}
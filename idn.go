@@ -0,0 +1,145 @@
+package purell
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusableScripts holds the scripts whose letters are commonly
+// mistaken for one another in homograph attacks.
+var confusableScripts = []*unicode.RangeTable{
+	unicode.Latin,
+	unicode.Greek,
+	unicode.Cyrillic,
+}
+
+// latinLookalikes holds the Cyrillic and Greek letters that the
+// Unicode confusables data (UTS #39) maps to Latin letters.
+const latinLookalikes = "\u0430\u0441\u0501\u0435\u04bb\u0456\u0458\u04cf\u043e\u0440\u051b\u0455\u051d\u0445\u0443" +
+	"\u03b1\u03b3\u03b9\u03bd\u03bf\u03c1\u03c5"
+
+// IsIDNConfusable reports whether the given host looks like a
+// homograph of another one. That is the case when one of its labels
+// mixes letters from several of the Latin, Greek and Cyrillic
+// scripts, as in "p\u0430ypal.com", or, in a host under an ASCII
+// top-level domain, when a Cyrillic or Greek label is only made of
+// letters confusable with Latin ones, as in
+// "\u0430\u0440\u0440\u04cf\u0435.com".
+// Punycode labels are decoded first. A port, if any, is ignored.
+func IsIDNConfusable(host string) bool {
+	if strings.HasPrefix(host, "[") {
+		return false
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	if h, err := idna.ToUnicode(host); err == nil {
+		host = h
+	}
+	labels := strings.Split(host, ".")
+	latinTLD := !hasNonASCII(labels[len(labels)-1])
+	for _, label := range labels {
+		var scripts int
+		for _, script := range confusableScripts {
+			if strings.IndexFunc(label, func(r rune) bool {
+				return unicode.Is(script, r)
+			}) >= 0 {
+				scripts++
+			}
+		}
+		if scripts > 1 || latinTLD && isLatinLookalike(label) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLatinLookalike reports whether the non-ASCII label is only made
+// of digits, hyphens and letters confusable with Latin ones.
+func isLatinLookalike(label string) bool {
+	return hasNonASCII(label) && strings.Trim(label, latinLookalikes+"-0123456789") == ""
+}
+
+// IRIToURI converts the given Internationalized Resource Identifier
+// (RFC 3987) to a URI: its host is converted to its IDNA punycode
+// form, and the non-ASCII characters of its other components are
+// percent-encoded as UTF-8. An error is returned when the IRI cannot
+// be parsed or its host is not a valid internationalized domain name.
+func IRIToURI(iri string) (string, error) {
+	u, err := url.Parse(iri)
+	if err != nil {
+		return "", err
+	}
+	if host := u.Hostname(); hasNonASCII(host) && !strings.HasPrefix(u.Host, "[") {
+		h, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", &url.Error{Op: "parse", URL: iri, Err: err}
+		}
+		if port := u.Port(); len(port) > 0 {
+			h += ":" + port
+		}
+		u.Host = h
+	}
+	if len(u.Opaque) > 0 {
+		u.Opaque = escapeNonASCII(u.Opaque)
+	} else {
+		setEscapedPath(u, escapeNonASCII(u.EscapedPath()))
+	}
+	u.RawQuery = escapeNonASCII(u.RawQuery)
+	setEscapedFragment(u, escapeNonASCII(u.EscapedFragment()))
+	return u.String(), nil
+}
+
+// escapeNonASCII returns s with its non-ASCII bytes percent-encoded.
+func escapeNonASCII(s string) string {
+	if !hasNonASCII(s) {
+		return s
+	}
+	buf := make([]byte, 0, len(s)*3)
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= utf8.RuneSelf {
+			buf = append(buf, '%', upperhex[c>>4], upperhex[c&15])
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
+
+func encodeHostPunycode(u *url.URL) {
+	host, port := u.Host, ""
+	if strings.HasPrefix(host, "[") {
+		return
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host, port = host[:i], host[i:]
+	}
+	if !hasNonASCII(host) || !utf8.ValidString(host) {
+		return
+	}
+	// The IDNA mapping of the lookup profile includes NFC, so
+	// that decomposed and precomposed hosts encode identically.
+	if h, err := idna.Lookup.ToASCII(host); err == nil {
+		u.Host = h + port
+	}
+}
+
+func normalizeUnicodeHostNFC(u *url.URL) {
+	if !strings.HasPrefix(u.Host, "[") && hasNonASCII(u.Host) && utf8.ValidString(u.Host) {
+		u.Host = norm.NFC.String(u.Host)
+	}
+}
+
+func hasNonASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package purell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// NormalizeJSONLines reads JSON objects from r, one per line, and
+// writes them to w with the string value of their given field
+// normalized with f. The other fields, and the order of all the
+// fields, are preserved, though insignificant white space is not.
+// Objects without the field, or whose field is not a valid URL
+// string, are written unchanged, as are blank lines. An error is
+// returned when a line does not hold a JSON object, once the lines
+// before it have been written.
+func NormalizeJSONLines(r io.Reader, w io.Writer, field string, f NormalizationFlags) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			out, lerr := normalizeJSONLine(line, field, f)
+			if lerr != nil {
+				bw.Flush()
+				return fmt.Errorf("line %d: %v", n, lerr)
+			}
+			bw.Write(out)
+			if line[len(line)-1] == '\n' {
+				bw.WriteByte('\n')
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			bw.Flush()
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// normalizeJSONLine returns the JSON object held in line, without
+// its trailing newline, with the given field normalized.
+func normalizeJSONLine(line []byte, field string, f NormalizationFlags) ([]byte, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(line)) == 0 {
+		return line, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, fmt.Errorf("expected JSON object")
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := t.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if key == field {
+			value = normalizeJSONString(value, f)
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(marshalJSONString(key))
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, value); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON object")
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// normalizeJSONString returns the JSON string value normalized
+// with f, or value itself if it is not a string holding a valid URL.
+func normalizeJSONString(value json.RawMessage, f NormalizationFlags) json.RawMessage {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return value
+	}
+	n, err := NormalizeURLString(s, f)
+	if err != nil {
+		return value
+	}
+	return marshalJSONString(n)
+}
+
+// marshalJSONString returns s as a JSON string, without escaping
+// the characters special to HTML, such as the & of queries.
+func marshalJSONString(s string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
@@ -0,0 +1,673 @@
+package purell
+
+import (
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Options holds the configuration of a Normalizer.
+type Options struct {
+	// Flags holds the normalizations to apply.
+	Flags NormalizationFlags
+
+	// OpaqueQuery specifies that the query must be left exactly
+	// as it is, for example because it is signed. When it is set,
+	// all query-affecting normalizations are no-ops.
+	OpaqueQuery bool
+
+	// StrictEncoding specifies that NormalizeString must return an
+	// error when the URL holds invalid percent-encoding. The url
+	// package already rejects it everywhere but in the query and
+	// in opaque URLs.
+	StrictEncoding bool
+
+	// RootPath specifies how the root path of URLs with a host
+	// is normalized. It is applied after all the flags, so it
+	// takes precedence over FlagRemoveTrailingSlash and
+	// FlagAddTrailingSlash for the root path.
+	RootPath RootPathPolicy
+
+	// SkipSchemes holds the schemes, compared case-insensitively,
+	// of the URLs that must be left untouched, such as "mailto"
+	// or "data", for which most normalizations are meaningless.
+	SkipSchemes []string
+
+	// PreserveQueryEncoding specifies that FlagSortQuery must
+	// reorder the query parameters as they are, rather than
+	// decoding and re-encoding them.
+	PreserveQueryEncoding bool
+
+	// RejectUserInfo specifies that NormalizeString must return
+	// a *UserInfoError when the URL holds user information.
+	RejectUserInfo bool
+
+	// Fragment specifies when the fragment of URLs is removed,
+	// depending on their other components. FlagRemoveFragment
+	// takes precedence over it.
+	Fragment FragmentPolicy
+
+	// SortListParams holds the keys of the query parameters whose
+	// value is an unordered, comma-separated list. The items of
+	// their values are sorted (?fields=b,a,c -> ?fields=a,b,c).
+	// Only literal commas separate items; encoded ones (%2C) are
+	// part of an item.
+	SortListParams []string
+
+	// MaxPathSegments holds the maximum number of segments of the
+	// path, once its dot segments are removed. NormalizeString
+	// returns a *PathSegmentsError for URLs with more segments.
+	// A trailing slash does not count as a segment. Zero means
+	// no limit.
+	MaxPathSegments int
+
+	// DuplicateKeys specifies what happens to the query parameters
+	// whose key appears more than once. FlagRemoveDuplicateQueryKeysKeepLast
+	// takes precedence over it.
+	DuplicateKeys DuplicateKeyPolicy
+
+	// EscapeCase specifies the case of the hexadecimal digits of the
+	// escapes of each component, for example when a partner requires
+	// lower case in the query only. It is applied after all the flags,
+	// so it takes precedence over FlagUppercaseEscapes and
+	// FlagLowercaseEscapes for the components it holds.
+	EscapeCase map[Component]CaseChoice
+
+	// RejectSchemes holds the schemes, compared case-insensitively,
+	// of the URLs for which NormalizeString must return a
+	// *SchemeError, such as those returned by DangerousSchemes.
+	// It takes precedence over SkipSchemes.
+	RejectSchemes []string
+
+	// CollapseDoubleEncoding specifies that one layer of percent-encoding
+	// must be removed from the path and the query when they look
+	// double-encoded (%2520 -> %20). To stay conservative, a component
+	// is only changed when all of its %25 escapes are followed by two
+	// hexadecimal digits, so that the result is validly encoded.
+	CollapseDoubleEncoding bool
+
+	// DefaultScheme and Base qualify the URLs given to NormalizeString
+	// that are not absolute, so that all its results are absolute:
+	//
+	//	- absolute URLs are left as they are;
+	//	- protocol-relative URLs (//example.com/a) take the scheme
+	//	  of Base, or DefaultScheme if Base is empty;
+	//	- other relative URLs are resolved against Base, if it is set;
+	//	- otherwise, those starting with something that looks like
+	//	  a host, such as example.com/a, are taken as schemeless ones,
+	//	  whose scheme is DefaultScheme. So are those such as
+	//	  example.com:8080/a or localhost:8080, whose host looks like
+	//	  a scheme, even when Base is set.
+	//
+	// A host must contain a dot or be localhost, optionally followed
+	// by a port. URLs are left as they are when the relevant option
+	// is empty, or when they do not start with a host and Base is
+	// empty: with only DefaultScheme set, /a, a/b and the empty URL
+	// remain relative.
+	DefaultScheme string
+	Base          string
+
+	// OnTransform, if not nil, is called after each normalization
+	// of Flags that changed the URL, with the flag of the normalization
+	// and copies of the URL before and after it, to trace normalization.
+	// Normalizations combining several flags, such as FlagForceHttp
+	// with FlagRemoveDefaultPortOnForce, are reported with all of them.
+	// It may be called concurrently when the Normalizer is used from
+	// several goroutines.
+	OnTransform func(flag NormalizationFlags, before, after *url.URL)
+
+	// HostSuffix, if not empty, is the default domain appended to
+	// single-label hosts, as in intranets (http://wiki/ ->
+	// http://wiki.corp.example.com/ with suffix corp.example.com).
+	// IP addresses, localhost and hosts with a dot are left untouched.
+	HostSuffix string
+
+	// TrimQueryValues holds the keys of the query parameters whose
+	// value is trimmed of its leading and trailing white space,
+	// whether literal or encoded as %20 or + (?q=%20hello+ -> ?q=hello),
+	// such as search terms.
+	TrimQueryValues []string
+
+	// SessionIDParams, if not nil, replaces the keys of the session
+	// identifier parameters removed by FlagRemoveSessionIDParams,
+	// which are listed by SessionIDParams by default.
+	SessionIDParams []string
+
+	// FreezeComponents holds the components left exactly as they
+	// are by all the normalizations, including EscapeCase, while the
+	// others are normalized. The path of opaque URLs such as mailto
+	// is frozen with ComponentPath. Freezing ComponentQuery is
+	// equivalent to OpaqueQuery.
+	FreezeComponents []Component
+}
+
+// DangerousSchemes returns the schemes that are commonly rejected
+// by link sanitizers, because they can run code in the browser,
+// for use as Options.RejectSchemes.
+func DangerousSchemes() []string {
+	return []string{"javascript", "data", "vbscript"}
+}
+
+// Component identifies a component of a URL whose escapes
+// may be normalized.
+type Component int
+
+// The components of a URL whose escapes may be normalized,
+// or that may be frozen.
+const (
+	ComponentPath Component = iota
+	ComponentQuery
+	ComponentFragment
+)
+
+// CaseChoice specifies the case of the hexadecimal digits
+// of escapes.
+type CaseChoice int
+
+const (
+	// CaseUnchanged leaves the escapes as they are.
+	CaseUnchanged CaseChoice = iota
+
+	// CaseUpper uses upper case (%3f -> %3F).
+	CaseUpper
+
+	// CaseLower uses lower case (%3F -> %3f).
+	CaseLower
+)
+
+// DuplicateKeyPolicy specifies what happens to the query
+// parameters of a URL whose key appears more than once.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeysKeepAll keeps all the parameters.
+	DuplicateKeysKeepAll DuplicateKeyPolicy = iota
+
+	// DuplicateKeysKeepFirst keeps the first parameter
+	// with a given key (?a=1&a=2 -> ?a=1).
+	DuplicateKeysKeepFirst
+
+	// DuplicateKeysKeepLast keeps the last parameter
+	// with a given key (?a=1&a=2 -> ?a=2).
+	DuplicateKeysKeepLast
+
+	// DuplicateKeysError makes NormalizeString return a
+	// *DuplicateKeyError when a key appears more than once
+	// with different values. The parameters are kept otherwise.
+	DuplicateKeysError
+)
+
+// FragmentPolicy specifies when the fragment of a URL is removed.
+type FragmentPolicy int
+
+const (
+	// FragmentKeep keeps the fragment.
+	FragmentKeep FragmentPolicy = iota
+
+	// FragmentKeepIfEmptyPath keeps the fragment only when the path
+	// is empty or / and there is no query, so that the fragment is
+	// the sole identifier of the resource within the site, as in
+	// single-page applications (http://x/#/page).
+	FragmentKeepIfEmptyPath
+)
+
+// UserInfoError is the error returned when a URL holds user
+// information and Options.RejectUserInfo is set.
+type UserInfoError struct {
+	// URL holds the offending URL, with its password redacted.
+	URL string
+}
+
+func (e *UserInfoError) Error() string {
+	return "url " + e.URL + " holds user information"
+}
+
+// PathSegmentsError is the error returned when the path of a URL
+// has more segments than allowed by Options.MaxPathSegments.
+type PathSegmentsError struct {
+	// URL holds the offending URL, with its password redacted.
+	URL string
+
+	// Segments holds the number of segments of the path.
+	Segments int
+}
+
+func (e *PathSegmentsError) Error() string {
+	return "url " + e.URL + " has " + strconv.Itoa(e.Segments) + " path segments"
+}
+
+// DuplicateKeyError is the error returned when a query key of a
+// URL has conflicting values and Options.DuplicateKeys is
+// DuplicateKeysError.
+type DuplicateKeyError struct {
+	// URL holds the offending URL, with its password redacted.
+	URL string
+
+	// Key holds the unescaped conflicting key.
+	Key string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return "url " + e.URL + " has conflicting values for query key " + strconv.Quote(e.Key)
+}
+
+// SchemeError is the error returned when the scheme of a URL
+// is one of Options.RejectSchemes.
+type SchemeError struct {
+	// URL holds the offending URL, with its password redacted.
+	URL string
+
+	// Scheme holds the rejected scheme.
+	Scheme string
+}
+
+func (e *SchemeError) Error() string {
+	return "url " + e.URL + " has rejected scheme " + e.Scheme
+}
+
+// RootPathPolicy specifies how the root path of a URL
+// with a host is normalized.
+type RootPathPolicy int
+
+const (
+	// RootPathUnchanged leaves the root path as it is, subject
+	// to FlagRemoveTrailingSlash and FlagAddTrailingSlash.
+	RootPathUnchanged RootPathPolicy = iota
+
+	// RootPathSlash uses / as the root path (http://x -> http://x/).
+	RootPathSlash
+
+	// RootPathEmpty uses an empty root path (http://x/ -> http://x).
+	RootPathEmpty
+)
+
+// Normalizer normalizes URLs according to a fixed set of options.
+// It is safe to use a Normalizer from several goroutines
+// concurrently, provided that its options are not changed
+// meanwhile.
+type Normalizer struct {
+	opts  Options
+	cache *cache
+
+	// steps holds the transforms applied by stepsFlags, computed
+	// once so that they need not be looked up on every call.
+	steps      []transform
+	stepsFlags NormalizationFlags
+}
+
+// NewNormalizer returns a Normalizer that normalizes URLs
+// according to the given options. The options are copied,
+// so later changes to opts do not affect the Normalizer.
+func NewNormalizer(opts *Options) *Normalizer {
+	n := &Normalizer{}
+	if opts != nil {
+		n.opts = *opts
+	}
+	n.steps, n.stepsFlags = applicableTransforms(n.opts.Flags), n.opts.Flags
+	return n
+}
+
+// NewCachedNormalizer is like NewNormalizer except that the
+// returned Normalizer remembers the results of NormalizeString
+// for the size most recently used URLs.
+func NewCachedNormalizer(opts *Options, size int) *Normalizer {
+	n := NewNormalizer(opts)
+	if size > 0 {
+		n.cache = newCache(size)
+	}
+	return n
+}
+
+// Clone returns a copy of n whose options may be changed
+// independently of those of n. The clone starts with an empty
+// cache of the same size as that of n, if any.
+func (n *Normalizer) Clone() *Normalizer {
+	c := &Normalizer{opts: n.opts, steps: n.steps, stepsFlags: n.stepsFlags}
+	c.opts.SkipSchemes = append([]string(nil), n.opts.SkipSchemes...)
+	c.opts.SortListParams = append([]string(nil), n.opts.SortListParams...)
+	c.opts.RejectSchemes = append([]string(nil), n.opts.RejectSchemes...)
+	c.opts.TrimQueryValues = append([]string(nil), n.opts.TrimQueryValues...)
+	if n.opts.SessionIDParams != nil {
+		c.opts.SessionIDParams = append([]string{}, n.opts.SessionIDParams...)
+	}
+	c.opts.FreezeComponents = append([]Component(nil), n.opts.FreezeComponents...)
+	if n.opts.EscapeCase != nil {
+		c.opts.EscapeCase = make(map[Component]CaseChoice, len(n.opts.EscapeCase))
+		for k, v := range n.opts.EscapeCase {
+			c.opts.EscapeCase[k] = v
+		}
+	}
+	if n.cache != nil {
+		c.cache = newCache(n.cache.size)
+	}
+	return c
+}
+
+// Options returns a pointer to the options of n, so that they
+// can be changed, typically on a Normalizer returned by Clone.
+// The options must not be changed while n is in use.
+func (n *Normalizer) Options() *Options {
+	return &n.opts
+}
+
+// NormalizeString returns the normalized form of the
+// given URL string.
+func (n *Normalizer) NormalizeString(s string) (string, error) {
+	if n.cache != nil {
+		if r, ok := n.cache.get(s); ok {
+			return r, nil
+		}
+	}
+	r, err := n.normalizeString(s, n.opts.Flags)
+	if err != nil {
+		return "", err
+	}
+	if n.cache != nil {
+		n.cache.add(s, r)
+	}
+	return r, nil
+}
+
+// NormalizeStringWith is like NormalizeString except that the
+// normalizations in extra are applied in addition to those of
+// the options of n, for this call only. The cache, if any, is
+// only used when extra is zero.
+func (n *Normalizer) NormalizeStringWith(s string, extra NormalizationFlags) (string, error) {
+	if extra == 0 {
+		return n.NormalizeString(s)
+	}
+	return n.normalizeString(s, n.opts.Flags|extra)
+}
+
+func (n *Normalizer) normalizeString(s string, f NormalizationFlags) (string, error) {
+	u, err := n.parse(s, f)
+	if err != nil {
+		return "", err
+	}
+	for _, scheme := range n.opts.RejectSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return "", &SchemeError{URL: u.Redacted(), Scheme: u.Scheme}
+		}
+	}
+	if n.opts.StrictEncoding {
+		for _, c := range []string{u.Opaque, u.RawQuery} {
+			if err := checkEscapes(c); err != nil {
+				return "", &url.Error{Op: "parse", URL: s, Err: err}
+			}
+		}
+	}
+	if n.opts.RejectUserInfo && u.User != nil {
+		return "", &UserInfoError{URL: u.Redacted()}
+	}
+	if n.opts.DuplicateKeys == DuplicateKeysError {
+		if k, ok := conflictingQueryKey(u.RawQuery); ok {
+			return "", &DuplicateKeyError{URL: u.Redacted(), Key: k}
+		}
+	}
+	n.normalizeURL(u, f)
+	if n.opts.MaxPathSegments > 0 {
+		if c := countPathSegments(u); c > n.opts.MaxPathSegments {
+			return "", &PathSegmentsError{URL: u.Redacted(), Segments: c}
+		}
+	}
+	return u.String(), nil
+}
+
+// parse parses s, qualifying it according to the DefaultScheme
+// and Base options.
+func (n *Normalizer) parse(s string, f NormalizationFlags) (*url.URL, error) {
+	u, err := parse(s, f)
+	if err == nil && u.IsAbs() && !isSchemelessHost(u) {
+		return u, nil
+	}
+	var base *url.URL
+	if len(n.opts.Base) > 0 {
+		var berr error
+		if base, berr = url.Parse(n.opts.Base); berr != nil {
+			return nil, berr
+		}
+	}
+	protocolRelative := err == nil && strings.HasPrefix(s, "//")
+	switch {
+	case protocolRelative && base != nil:
+		u.Scheme = base.Scheme
+		return u, nil
+	case protocolRelative && len(n.opts.DefaultScheme) > 0:
+		u.Scheme = n.opts.DefaultScheme
+		return u, nil
+	case err == nil && base != nil && !u.IsAbs():
+		return base.ResolveReference(u), nil
+	case len(n.opts.DefaultScheme) > 0 && hasHostPrefix(s):
+		return parse(n.opts.DefaultScheme+"://"+s, f)
+	}
+	return u, err
+}
+
+// isSchemelessHost reports whether u, parsed from a string such
+// as example.com:8080/a or localhost:8080, is in fact a schemeless
+// URL whose host was taken for a scheme.
+func isSchemelessHost(u *url.URL) bool {
+	return len(u.Opaque) > 0 && isHostName(u.Scheme)
+}
+
+// hasHostPrefix reports whether the first segment of the
+// schemeless URL s looks like a host, optionally preceded by
+// user information and followed by a port.
+func hasHostPrefix(s string) bool {
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 && isDigits(s[i+1:]) {
+		s = s[:i]
+	}
+	return isHostName(s)
+}
+
+// isHostName reports whether s looks like a host name rather
+// than a scheme or a path segment.
+func isHostName(s string) bool {
+	return strings.Contains(s, ".") || strings.EqualFold(s, "localhost")
+}
+
+// NormalizeAll normalizes urls concurrently with the given number
+// of goroutines, or GOMAXPROCS if workers is not positive. The
+// normalized URLs and the errors are returned at the same index
+// as their URL; the errors are nil for the URLs normalized
+// successfully, and the normalized URLs empty for the others.
+func (n *Normalizer) NormalizeAll(urls []string, workers int) ([]string, []error) {
+	normalized := make([]string, len(urls))
+	errs := make([]error, len(urls))
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(urls) {
+		workers = len(urls)
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				normalized[i], errs[i] = n.NormalizeString(urls[i])
+			}
+		}()
+	}
+	for i := range urls {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return normalized, errs
+}
+
+// Normalize is like NormalizeString but also reports whether
+// the normalized URL differs from s.
+func (n *Normalizer) Normalize(s string) (normalized string, changed bool, err error) {
+	normalized, err = n.NormalizeString(s)
+	if err != nil {
+		return "", false, err
+	}
+	return normalized, normalized != s, nil
+}
+
+// NormalizeURL normalizes the given URL in place.
+func (n *Normalizer) NormalizeURL(u *url.URL) {
+	n.normalizeURL(u, n.opts.Flags)
+}
+
+func (n *Normalizer) normalizeURL(u *url.URL, f NormalizationFlags) {
+	for _, scheme := range n.opts.SkipSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return
+		}
+	}
+	if normalizeViewSource(u, f, func(inner *url.URL) { n.normalizeURL(inner, f) }) {
+		return
+	}
+	frozen := *u
+	opaqueQuery := n.opts.OpaqueQuery
+	var skip NormalizationFlags
+	for _, c := range n.opts.FreezeComponents {
+		switch c {
+		case ComponentPath:
+			// The host would be taken from the frozen path.
+			skip |= FlagNormalizeEmptyAuthority
+		case ComponentQuery:
+			opaqueQuery = true
+		}
+	}
+	if opaqueQuery {
+		skip |= queryFlags
+	}
+	if len(n.opts.TrimQueryValues) > 0 && !opaqueQuery {
+		trimQueryValues(u, n.opts.TrimQueryValues)
+	}
+	if len(n.opts.SortListParams) > 0 && !opaqueQuery {
+		sortListParams(u, n.opts.SortListParams)
+	}
+	if len(n.opts.HostSuffix) > 0 {
+		qualifyHost(u, n.opts.HostSuffix)
+	}
+	if n.opts.CollapseDoubleEncoding {
+		mapEscapedComponent(u, ComponentPath, collapseDoubleEncoding)
+		if !opaqueQuery {
+			mapEscapedComponent(u, ComponentQuery, collapseDoubleEncoding)
+		}
+	}
+	switch {
+	case opaqueQuery:
+	case n.opts.DuplicateKeys == DuplicateKeysKeepFirst:
+		removeDuplicateQueryKeys(u, false)
+	case n.opts.DuplicateKeys == DuplicateKeysKeepLast:
+		removeDuplicateQueryKeys(u, true)
+	}
+	steps := n.steps
+	if f != n.stepsFlags {
+		// The flags were changed through Options or extended
+		// by NormalizeStringWith.
+		steps = transforms
+	}
+	for _, t := range steps {
+		if f&t.flag != t.flag || t.flag&skip != 0 {
+			continue
+		}
+		normalize := t.normalize
+		if t.flag == FlagSortQuery && n.opts.PreserveQueryEncoding {
+			normalize = sortRawQuery
+		}
+		if t.flag == FlagRemoveSessionIDParams && n.opts.SessionIDParams != nil {
+			normalize = func(u *url.URL) { removeParams(u, n.opts.SessionIDParams) }
+		}
+		if opaqueQuery {
+			// The normalizations left, such as FlagUppercaseEscapes,
+			// affect the query along with other components.
+			normalize = keepQuery(normalize)
+		}
+		if n.opts.OnTransform == nil {
+			normalize(u)
+			continue
+		}
+		before := *u
+		normalize(u)
+		if !equalURL(&before, u) {
+			after := *u
+			n.opts.OnTransform(t.flag, &before, &after)
+		}
+	}
+	if len(u.Host) > 0 {
+		switch {
+		case n.opts.RootPath == RootPathSlash && len(u.Path) == 0:
+			u.Path = "/"
+		case n.opts.RootPath == RootPathEmpty && u.Path == "/":
+			u.Path, u.RawPath = "", ""
+		}
+	}
+	for c, choice := range n.opts.EscapeCase {
+		if c == ComponentQuery && opaqueQuery {
+			continue
+		}
+		switch choice {
+		case CaseUpper:
+			mapEscapedComponent(u, c, uppercaseEscapesString)
+		case CaseLower:
+			mapEscapedComponent(u, c, lowercaseEscapesString)
+		}
+	}
+	if n.opts.Fragment == FragmentKeepIfEmptyPath && (len(u.Path) > 1 || len(u.Opaque) > 0 || len(u.RawQuery) > 0) {
+		removeFragment(u)
+	}
+	for _, c := range n.opts.FreezeComponents {
+		switch c {
+		case ComponentPath:
+			u.Opaque, u.Path, u.RawPath = frozen.Opaque, frozen.Path, frozen.RawPath
+		case ComponentFragment:
+			u.Fragment, u.RawFragment = frozen.Fragment, frozen.RawFragment
+		}
+	}
+}
+
+// keepQuery returns a function applying normalize to a URL
+// without changing its query.
+func keepQuery(normalize func(*url.URL)) func(*url.URL) {
+	return func(u *url.URL) {
+		query, forceQuery := u.RawQuery, u.ForceQuery
+		normalize(u)
+		u.RawQuery, u.ForceQuery = query, forceQuery
+	}
+}
+
+// countPathSegments returns the number of segments of the path of u,
+// once its dot segments are removed, ignoring any trailing slash.
+func countPathSegments(u *url.URL) int {
+	p := RemoveDotSegments(u.EscapedPath())
+	p = strings.TrimPrefix(strings.TrimSuffix(p, "/"), "/")
+	if len(p) == 0 {
+		return 0
+	}
+	return strings.Count(p, "/") + 1
+}
+
+// qualifyHost appends the domain suffix to the host of u,
+// if it is a single-label one.
+func qualifyHost(u *url.URL, suffix string) {
+	host := u.Hostname()
+	if len(host) == 0 || strings.Contains(u.Host, "[") || strings.Contains(host, ".") || strings.EqualFold(host, "localhost") {
+		return
+	}
+	if _, err := strconv.ParseUint(host, 0, 32); err == nil {
+		// A numeric IPv4 address, such as 2130706433.
+		return
+	}
+	host += "." + strings.Trim(suffix, ".")
+	if port := u.Port(); len(port) > 0 {
+		host += ":" + port
+	}
+	u.Host = host
+}
@@ -0,0 +1,815 @@
+package purell
+
+import (
+	"github.com/rogpeppe/purell"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCachedNormalizer(t *testing.T) {
+	n := purell.NewCachedNormalizer(&purell.Options{Flags: purell.FlagsUnsafe}, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, test := range tests {
+				if test.flags != purell.FlagsUnsafe {
+					continue
+				}
+				want, err := purell.NormalizeURLString(test.url, test.flags)
+				if err != nil {
+					t.Errorf("got error on %q: %v", test.url, err)
+					continue
+				}
+				// Normalize twice so that the second call hits the cache.
+				for j := 0; j < 2; j++ {
+					got, err := n.NormalizeString(test.url)
+					if err != nil {
+						t.Errorf("got error on %q: %v", test.url, err)
+					} else if got != want {
+						t.Errorf("normalizing url %q: expected %q; got %q", test.url, want, got)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestClone(t *testing.T) {
+	n := purell.NewCachedNormalizer(&purell.Options{
+		Flags:       purell.FlagsSafe,
+		SkipSchemes: []string{"mailto"},
+	}, 10)
+	c := n.Clone()
+	c.Options().Flags |= purell.FlagSortQuery
+	c.Options().SkipSchemes[0] = "data"
+	c.Options().SkipSchemes = append(c.Options().SkipSchemes, "urn")
+
+	if got := n.Options().Flags; got != purell.FlagsSafe {
+		t.Errorf("original flags changed to %d", got)
+	}
+	if got := n.Options().SkipSchemes; len(got) != 1 || got[0] != "mailto" {
+		t.Errorf("original skipped schemes changed to %q", got)
+	}
+	for _, test := range []struct {
+		n      *purell.Normalizer
+		url    string
+		expect string
+	}{
+		{n, "HTTP://x/?b=1&a=2", "http://x/?b=1&a=2"},
+		{c, "HTTP://x/?b=1&a=2", "http://x/?a=2&b=1"},
+		{n, "mailto:a@b?x=%7e", "mailto:a@b?x=%7e"},
+		{c, "mailto:a@b?x=%7e", "mailto:a@b?x=~"},
+	} {
+		got, err := test.n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q: expected %q; got %q", test.url, test.expect, got)
+		}
+	}
+}
+
+func TestNormalizeStringWith(t *testing.T) {
+	n := purell.NewCachedNormalizer(&purell.Options{Flags: purell.FlagsSafe}, 10)
+	const u = "HTTP://Example.com/a/?b=2&a=1#c"
+	for _, test := range []struct {
+		extra  purell.NormalizationFlags
+		expect string
+	}{
+		{0, "http://example.com/a/?b=2&a=1#c"},
+		{purell.FlagSortQuery | purell.FlagRemoveFragment, "http://example.com/a/?a=1&b=2"},
+		{purell.FlagRemoveTrailingSlash, "http://example.com/a?b=2&a=1#c"},
+		{0, "http://example.com/a/?b=2&a=1#c"},
+	} {
+		got, err := n.NormalizeStringWith(u, test.extra)
+		if err != nil {
+			t.Errorf("got error with extra flags %d: %v", test.extra, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q with extra flags %d: expected %q; got %q", u, test.extra, test.expect, got)
+		}
+	}
+	if got := n.Options().Flags; got != purell.FlagsSafe {
+		t.Errorf("flags changed to %d", got)
+	}
+	if got, _ := n.NormalizeString(u); got != "http://example.com/a/?b=2&a=1#c" {
+		t.Errorf("base normalization changed to %q", got)
+	}
+}
+
+func TestOpaqueQuery(t *testing.T) {
+	const u = "http://EXAMPLE.com/p?b=2&a=1&a=0&sig=A%2fb%3D&x=a+b"
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:       purell.FlagLowercaseHost | purell.FlagSortQuery | purell.FlagRemoveEmptyQuerySeparator,
+		OpaqueQuery: true,
+	})
+	got, err := n.NormalizeString(u)
+	if err != nil {
+		t.Fatalf("got error on %q: %v", u, err)
+	}
+	if want := "http://example.com/p?b=2&a=1&a=0&sig=A%2fb%3D&x=a+b"; got != want {
+		t.Errorf("normalizing url %q: expected %q; got %q", u, want, got)
+	}
+}
+
+var strictEncodingTests = []struct {
+	url   string
+	valid bool
+}{
+	{"http://x/?q=%ZZ", false},
+	{"http://x/?q=%", false},
+	{"http://x/?q=%A", false},
+	{"http://x/?q=%A&r=1", false},
+	{"mailto:a%ZZ@b", false},
+	{"http://x/?q=%2A", true},
+	{"http://x/?q=a", true},
+	{"mailto:a%?41", false},
+	{"mailto:a%4?1b", false},
+}
+
+func TestStrictEncoding(t *testing.T) {
+	strict := purell.NewNormalizer(&purell.Options{StrictEncoding: true})
+	lenient := purell.NewNormalizer(nil)
+	for _, test := range strictEncodingTests {
+		_, err := strict.NormalizeString(test.url)
+		if test.valid && err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected error on %q", test.url)
+		}
+		if _, err := lenient.NormalizeString(test.url); err != nil {
+			t.Errorf("got error on %q without strict encoding: %v", test.url, err)
+		}
+	}
+}
+
+var changedTests = []struct {
+	url     string
+	expect  string
+	changed bool
+}{
+	{"http://Example.com:80/a/./b", "http://example.com/a/b", true},
+	{"http://example.com/a/b", "http://example.com/a/b", false},
+}
+
+func TestNormalizeChanged(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{Flags: purell.FlagsUsuallySafe})
+	for _, test := range changedTests {
+		got, changed, err := n.Normalize(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect || changed != test.changed {
+			t.Errorf("normalizing url %q: expected %q, %v; got %q, %v", test.url, test.expect, test.changed, got, changed)
+		}
+	}
+	if _, changed, err := n.Normalize("http://[::1"); err == nil || changed {
+		t.Errorf("expected error and no change on invalid url; got %v, %v", err, changed)
+	}
+}
+
+var rootPathTests = []struct {
+	url    string
+	flags  purell.NormalizationFlags
+	policy purell.RootPathPolicy
+	expect string
+}{
+	{"http://x/", 0, purell.RootPathUnchanged, "http://x/"},
+	{"http://x", 0, purell.RootPathUnchanged, "http://x"},
+	{"http://x/", 0, purell.RootPathSlash, "http://x/"},
+	{"http://x", 0, purell.RootPathSlash, "http://x/"},
+	{"http://x/", 0, purell.RootPathEmpty, "http://x"},
+	{"http://x", 0, purell.RootPathEmpty, "http://x"},
+	{"http://x/?a=1", 0, purell.RootPathEmpty, "http://x?a=1"},
+	{"http://x/a/", 0, purell.RootPathEmpty, "http://x/a/"},
+	{"http://x/", purell.FlagRemoveTrailingSlash, purell.RootPathSlash, "http://x/"},
+	{"http://x", purell.FlagAddTrailingSlash, purell.RootPathEmpty, "http://x"},
+	{"file:///", 0, purell.RootPathEmpty, "file:///"},
+}
+
+func TestRootPath(t *testing.T) {
+	for _, test := range rootPathTests {
+		n := purell.NewNormalizer(&purell.Options{Flags: test.flags, RootPath: test.policy})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q, flags %v, policy %v: expected %q; got %q", test.url, test.flags, test.policy, test.expect, got)
+		}
+	}
+}
+
+func TestSkipSchemes(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:       purell.FlagsUnsafe,
+		SkipSchemes: []string{"mailto", "data"},
+	})
+	for _, u := range []string{
+		"mailto:A@B.com?subject=Hi%20there&body=x#frag",
+		"data:text/plain;base64,SGVsbG8=",
+		"DATA:,A%20b",
+	} {
+		got, err := n.NormalizeString(u)
+		if err != nil {
+			t.Errorf("got error on %q: %v", u, err)
+		} else if want, _ := url.Parse(u); got != want.String() {
+			t.Errorf("normalizing url %q: expected %q; got %q", u, want, got)
+		}
+	}
+	got, err := n.NormalizeString("HTTP://Example.com/a?b=1#c")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := "http://example.com/a?b=1"; got != want {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+}
+
+var preserveQueryEncodingTests = []struct {
+	url      string
+	preserve bool
+	expect   string
+}{
+	{"http://x/?b=a%2Bb&a=c%20d&b=a", false, "http://x/?a=c+d&b=a&b=a%2Bb"},
+	{"http://x/?b=a%2Bb&a=c%20d&b=a", true, "http://x/?a=c%20d&b=a&b=a%2Bb"},
+	{"http://x/?b=%2B&b=+&a", true, "http://x/?a&b=+&b=%2B"},
+}
+
+func TestPreserveQueryEncoding(t *testing.T) {
+	for _, test := range preserveQueryEncodingTests {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:                 purell.FlagSortQuery,
+			PreserveQueryEncoding: test.preserve,
+		})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q, preserve %v: expected %q; got %q", test.url, test.preserve, test.expect, got)
+		}
+	}
+}
+
+var sortListParamsTests = []struct {
+	url    string
+	flags  purell.NormalizationFlags
+	expect string
+}{
+	{"http://x/?fields=b,a,c", 0, "http://x/?fields=a,b,c"},
+	{"http://x/?order=b,a,c&fields=b,%41,c", 0, "http://x/?order=b,a,c&fields=%41,b,c"},
+	{"http://x/?fields=b%2Ca,a", 0, "http://x/?fields=a,b%2Ca"},
+	{"http://x/?fields", 0, "http://x/?fields"},
+	{"http://x/?z=1&fields=c,b", purell.FlagSortQuery, "http://x/?fields=b%2Cc&z=1"},
+}
+
+func TestSortListParams(t *testing.T) {
+	for _, test := range sortListParamsTests {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:          test.flags,
+			SortListParams: []string{"fields"},
+		})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q: expected %q; got %q", test.url, test.expect, got)
+		}
+	}
+}
+
+func TestRejectUserInfo(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{RejectUserInfo: true})
+	_, err := n.NormalizeString("http://user:pass@x/")
+	uerr, ok := err.(*purell.UserInfoError)
+	if !ok {
+		t.Fatalf("expected *UserInfoError; got %#v", err)
+	}
+	if strings.Contains(uerr.Error(), "pass") {
+		t.Errorf("error %q holds the password", uerr)
+	}
+	if _, err := n.NormalizeString("http://user@x/"); err == nil {
+		t.Errorf("expected error for url with user name")
+	}
+	if _, err := n.NormalizeString("http://x/"); err != nil {
+		t.Errorf("got error on plain url: %v", err)
+	}
+}
+
+var fragmentPolicyTests = []struct {
+	url    string
+	policy purell.FragmentPolicy
+	expect string
+}{
+	{"http://x/a#frag", purell.FragmentKeep, "http://x/a#frag"},
+	{"http://x/#frag", purell.FragmentKeep, "http://x/#frag"},
+	{"http://x/a#frag", purell.FragmentKeepIfEmptyPath, "http://x/a"},
+	{"http://x/?a=1#frag", purell.FragmentKeepIfEmptyPath, "http://x/?a=1"},
+	{"http://x/#/page", purell.FragmentKeepIfEmptyPath, "http://x/#/page"},
+	{"http://x#frag", purell.FragmentKeepIfEmptyPath, "http://x#frag"},
+}
+
+func TestFragmentPolicy(t *testing.T) {
+	for _, test := range fragmentPolicyTests {
+		n := purell.NewNormalizer(&purell.Options{Fragment: test.policy})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q, policy %v: expected %q; got %q", test.url, test.policy, test.expect, got)
+		}
+	}
+}
+
+var maxPathSegmentsTests = []struct {
+	url string
+	ok  bool
+}{
+	{"http://x", true},
+	{"http://x/", true},
+	{"http://x/a/b/c", true},
+	{"http://x/a/b/c/", true},
+	{"http://x/a/b/c/d", false},
+	{"http://x/a/b/c/d/../", true},
+	{"http://x/a/./b/./c/.", true},
+	{"http://x/a/b%2Fc%2Fd/e", true},
+	{"http://x/a//b/c", false},
+	{"http://x/a/b/c/d?e/f", false},
+}
+
+func TestMaxPathSegments(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{MaxPathSegments: 3})
+	for _, test := range maxPathSegmentsTests {
+		_, err := n.NormalizeString(test.url)
+		if test.ok {
+			if err != nil {
+				t.Errorf("got error on %q: %v", test.url, err)
+			}
+			continue
+		}
+		if perr, ok := err.(*purell.PathSegmentsError); !ok {
+			t.Errorf("expected *PathSegmentsError on %q; got %#v", test.url, err)
+		} else if perr.Segments != 4 {
+			t.Errorf("expected 4 segments for %q; got %d", test.url, perr.Segments)
+		}
+	}
+}
+
+var duplicateKeysTests = []struct {
+	url    string
+	policy purell.DuplicateKeyPolicy
+	expect string
+	err    bool
+}{
+	{"http://x/?a=1&a=2", purell.DuplicateKeysKeepAll, "http://x/?a=1&a=2", false},
+	{"http://x/?a=1&a=2", purell.DuplicateKeysKeepFirst, "http://x/?a=1", false},
+	{"http://x/?a=1&a=2", purell.DuplicateKeysKeepLast, "http://x/?a=2", false},
+	{"http://x/?a=1&a=2", purell.DuplicateKeysError, "", true},
+	{"http://x/?a=1&b=3&a=2&b=4", purell.DuplicateKeysKeepFirst, "http://x/?a=1&b=3", false},
+	{"http://x/?a=1&b=3&a=2&b=4", purell.DuplicateKeysKeepLast, "http://x/?a=2&b=4", false},
+	{"http://x/?a=%41&a=A", purell.DuplicateKeysError, "http://x/?a=%41&a=A", false},
+	{"http://x/?a=1&b=2", purell.DuplicateKeysError, "http://x/?a=1&b=2", false},
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	for _, test := range duplicateKeysTests {
+		n := purell.NewNormalizer(&purell.Options{DuplicateKeys: test.policy})
+		got, err := n.NormalizeString(test.url)
+		if test.err {
+			if _, ok := err.(*purell.DuplicateKeyError); !ok {
+				t.Errorf("expected *DuplicateKeyError on %q with policy %d; got %#v", test.url, test.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("got error on %q with policy %d: %v", test.url, test.policy, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q with policy %d: expected %q; got %q", test.url, test.policy, test.expect, got)
+		}
+	}
+}
+
+var escapeCaseTests = []struct {
+	flags      purell.NormalizationFlags
+	escapeCase map[purell.Component]purell.CaseChoice
+	expect     string
+}{
+	{0, nil, "http://x/a%2fb%C3%a9?q=%2fb%C3%a9#%2fb%C3%a9"},
+	{purell.FlagUppercaseEscapes, map[purell.Component]purell.CaseChoice{
+		purell.ComponentQuery: purell.CaseLower,
+	}, "http://x/a%2Fb%C3%A9?q=%2fb%c3%a9#%2Fb%C3%A9"},
+	{0, map[purell.Component]purell.CaseChoice{
+		purell.ComponentPath:     purell.CaseUpper,
+		purell.ComponentQuery:    purell.CaseLower,
+		purell.ComponentFragment: purell.CaseUnchanged,
+	}, "http://x/a%2Fb%C3%A9?q=%2fb%c3%a9#%2fb%C3%a9"},
+	{purell.FlagLowercaseEscapes, map[purell.Component]purell.CaseChoice{
+		purell.ComponentFragment: purell.CaseUpper,
+	}, "http://x/a%2fb%c3%a9?q=%2fb%c3%a9#%2Fb%C3%A9"},
+}
+
+func TestEscapeCase(t *testing.T) {
+	const u = "http://x/a%2fb%C3%a9?q=%2fb%C3%a9#%2fb%C3%a9"
+	for _, test := range escapeCaseTests {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:      test.flags,
+			EscapeCase: test.escapeCase,
+		})
+		got, err := n.NormalizeString(u)
+		if err != nil {
+			t.Errorf("got error with escape case %v: %v", test.escapeCase, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q with escape case %v: expected %q; got %q", u, test.escapeCase, test.expect, got)
+		}
+	}
+}
+
+func TestRejectSchemes(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:         purell.FlagsSafe,
+		RejectSchemes: purell.DangerousSchemes(),
+		SkipSchemes:   []string{"data"},
+	})
+	for _, u := range []string{
+		"javascript:alert(1)",
+		"JavaScript:alert(1)",
+		"data:text/html,<script>alert(1)</script>",
+		"vbscript:msgbox(1)",
+	} {
+		_, err := n.NormalizeString(u)
+		if serr, ok := err.(*purell.SchemeError); !ok {
+			t.Errorf("expected *SchemeError on %q; got %#v", u, err)
+		} else if !strings.EqualFold(serr.Scheme, u[:strings.Index(u, ":")]) {
+			t.Errorf("expected scheme of %q in error; got %q", u, serr.Scheme)
+		}
+	}
+	for _, u := range []string{"http://x/javascript:alert(1)", "about:blank", "mailto:a@b"} {
+		if _, err := n.NormalizeString(u); err != nil {
+			t.Errorf("got error on %q: %v", u, err)
+		}
+	}
+	n = purell.NewNormalizer(nil)
+	if _, err := n.NormalizeString("javascript:alert(1)"); err != nil {
+		t.Errorf("got error without rejected schemes: %v", err)
+	}
+}
+
+// emptyQueryTests holds URLs whose query parameters are all
+// removed, to check that no query-affecting normalization
+// leaves a ? behind.
+var emptyQueryTests = []struct {
+	url    string
+	opts   purell.Options
+	expect string
+}{
+	{"http://x/?", purell.Options{Flags: purell.FlagRemoveEmptyQuerySeparator}, "http://x/"},
+	{"http://x/?", purell.Options{Flags: purell.FlagsSafe}, "http://x/"},
+	{"http://x/?&", purell.Options{Flags: purell.FlagSortQuery}, "http://x/"},
+	{"http://x/?&&#f", purell.Options{Flags: purell.FlagsUnsafe &^ purell.FlagRemoveFragment}, "http://x#f"},
+	{"http://x/?&&", purell.Options{Flags: purell.FlagCanonicalizeQuery}, "http://x/"},
+	{"http://x/?&?&", purell.Options{Flags: purell.FlagRemoveRedundantQuestionMarkAndAmpersand}, "http://x/"},
+	{"http://x/?&", purell.Options{Flags: purell.FlagSortQuery, PreserveQueryEncoding: true}, "http://x/"},
+	{"http://x/?", purell.Options{Flags: purell.FlagSortQuery | purell.FlagRemoveEmptyQuerySeparator, DuplicateKeys: purell.DuplicateKeysKeepFirst}, "http://x/"},
+	{"http://x/?utm_source=a&&gclid=b", purell.Options{Flags: purell.FlagRemoveTrackingParams}, "http://x/"},
+	{"http://x/?", purell.Options{Flags: purell.FlagsSafe, OpaqueQuery: true}, "http://x/?"},
+}
+
+func TestEmptyQueryRemoval(t *testing.T) {
+	for _, test := range emptyQueryTests {
+		opts := test.opts
+		got, err := purell.NewNormalizer(&opts).NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q with flags %d: expected %q; got %q", test.url, test.opts.Flags, test.expect, got)
+		}
+	}
+}
+
+var doubleEncodingTests = []struct {
+	url    string
+	flags  purell.NormalizationFlags
+	expect string
+}{
+	{"http://x/a%2520b?q=c%2520d#e%2520f", 0, "http://x/a%20b?q=c%20d#e%2520f"},
+	{"http://x/a%20b?q=c%20d", 0, "http://x/a%20b?q=c%20d"},
+	{"http://x/a%252Fb", 0, "http://x/a%2Fb"},
+	{"http://x/100%25?q=50%25%2520off", 0, "http://x/100%25?q=50%25%2520off"},
+	{"http://x/a%2520b?q=%25zz", 0, "http://x/a%20b?q=%25zz"},
+	{"http://x/a%2541", purell.FlagDecodeUnnecessaryEscapes, "http://x/aA"},
+}
+
+func TestCollapseDoubleEncoding(t *testing.T) {
+	for _, test := range doubleEncodingTests {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:                  test.flags,
+			CollapseDoubleEncoding: true,
+		})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q: expected %q; got %q", test.url, test.expect, got)
+		}
+	}
+}
+
+var qualifyTests = []struct {
+	url           string
+	defaultScheme string
+	base          string
+	expect        string
+}{
+	{"HTTPS://Example.com/a", "http", "http://base.com/x/y", "https://example.com/a"},
+	{"//Example.com/a", "http", "https://base.com/x/y", "https://example.com/a"},
+	{"//Example.com/a", "http", "", "http://example.com/a"},
+	{"/a/./b", "http", "https://base.com/x/y", "https://base.com/a/b"},
+	{"b?c=d", "http", "https://base.com/x/y", "https://base.com/x/b?c=d"},
+	{"Example.com/a", "http", "", "http://example.com/a"},
+	{"Example.com:8080/a", "https", "", "https://example.com:8080/a"},
+	{"localhost:8080", "http", "", "http://localhost:8080"},
+	{"Example.com:8080/a", "https", "http://base.com/", "https://example.com:8080/a"},
+	{"mailto:a@b", "http", "http://base.com/", "mailto:a@b"},
+	{"/a", "", "", "/a"},
+	{"/a", "http", "", "/a"},
+	{"a/b", "http", "", "a/b"},
+	{"", "http", "", ""},
+	{"user@Example.com:8080?q", "http", "", "http://user@example.com:8080?q"},
+	{"//Example.com/a", "", "", "//example.com/a"},
+}
+
+func TestDefaultSchemeAndBase(t *testing.T) {
+	for _, test := range qualifyTests {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:         purell.FlagsUsuallySafe,
+			DefaultScheme: test.defaultScheme,
+			Base:          test.base,
+		})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q with scheme %q and base %q: expected %q; got %q", test.url, test.defaultScheme, test.base, test.expect, got)
+		}
+	}
+	n := purell.NewNormalizer(&purell.Options{Base: "http://[::1"})
+	if _, err := n.NormalizeString("/a"); err == nil {
+		t.Errorf("expected error with invalid base")
+	}
+}
+
+func TestOnTransform(t *testing.T) {
+	var flags []purell.NormalizationFlags
+	n := purell.NewNormalizer(&purell.Options{
+		Flags: purell.FlagsUsuallySafe | purell.FlagSortQuery,
+		OnTransform: func(flag purell.NormalizationFlags, before, after *url.URL) {
+			if before.String() == after.String() {
+				t.Errorf("hook called for flag %d without change to %q", flag, after)
+			}
+			flags = append(flags, flag)
+		},
+	})
+	got, err := n.NormalizeString("http://Example.com:80/a/./b/?y=1&x=2")
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := "http://example.com/a/b?x=2&y=1"; got != want {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+	want := []purell.NormalizationFlags{
+		purell.FlagLowercaseHost,
+		purell.FlagRemoveTrailingSlash,
+		purell.FlagRemoveDotSegments,
+		purell.FlagRemoveDefaultPort,
+		purell.FlagSortQuery,
+	}
+	if !reflect.DeepEqual(flags, want) {
+		t.Errorf("expected hook calls for flags %v; got %v", want, flags)
+	}
+
+	flags = nil
+	if _, err := n.NormalizeString("http://example.com/a"); err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if len(flags) != 0 {
+		t.Errorf("expected no hook call for normalized url; got %v", flags)
+	}
+}
+
+func TestOnTransformOpaqueQuery(t *testing.T) {
+	const u = "http://EXAMPLE.com/a/./%7e?&b=%7e+&utm_source=x&a=1;c=2&&"
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:       ^purell.NormalizationFlags(0),
+		OpaqueQuery: true,
+		OnTransform: func(flag purell.NormalizationFlags, before, after *url.URL) {
+			if before.RawQuery != after.RawQuery || before.ForceQuery != after.ForceQuery {
+				t.Errorf("hook called for flag %v with query change %q -> %q", flag, before.RawQuery, after.RawQuery)
+			}
+		},
+	})
+	got, err := n.NormalizeString(u)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := "?&b=%7e+&utm_source=x&a=1;c=2&&"; !strings.HasSuffix(got, want) {
+		t.Errorf("normalizing url %q: expected query %q; got %q", u, want, got)
+	}
+}
+
+var hostSuffixTests = []struct {
+	url    string
+	expect string
+}{
+	{"http://wiki/", "http://wiki.corp.local/"},
+	{"http://WIKI:8080/a", "http://wiki.corp.local:8080/a"},
+	{"http://u@wiki/", "http://u@wiki.corp.local/"},
+	{"http://wiki.example.com/", "http://wiki.example.com/"},
+	{"http://wiki./", "http://wiki./"},
+	{"http://localhost:8080/", "http://localhost:8080/"},
+	{"http://127.0.0.1/", "http://127.0.0.1/"},
+	{"http://2130706433/", "http://2130706433/"},
+	{"http://[::1]/", "http://[::1]/"},
+	{"file:///etc/hosts", "file:///etc/hosts"},
+	{"mailto:a@b", "mailto:a@b"},
+}
+
+func TestHostSuffix(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:      purell.FlagsSafe,
+		HostSuffix: ".corp.local",
+	})
+	for _, test := range hostSuffixTests {
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q: expected %q; got %q", test.url, test.expect, got)
+		}
+	}
+}
+
+var trimQueryValuesTests = []struct {
+	url    string
+	expect string
+}{
+	{"http://x/?q=%20hello%20", "http://x/?q=hello"},
+	{"http://x/?q=+%20hello+world%09+&id=%20a%20", "http://x/?q=hello+world&id=%20a%20"},
+	{"http://x/?q=%20%20&q=a%0A", "http://x/?q=&q=a"},
+	{"http://x/?q&s=%20b", "http://x/?q&s=b"},
+}
+
+func TestTrimQueryValues(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{TrimQueryValues: []string{"q", "s"}})
+	for _, test := range trimQueryValuesTests {
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("got error on %q: %v", test.url, err)
+		} else if got != test.expect {
+			t.Errorf("normalizing url %q: expected %q; got %q", test.url, test.expect, got)
+		}
+	}
+}
+
+func TestSessionIDParams(t *testing.T) {
+	const u = "http://x/page;jsessionid=1;token=2?sid=3&token=4"
+	n := purell.NewNormalizer(&purell.Options{
+		Flags:           purell.FlagRemoveSessionIDParams,
+		SessionIDParams: append(purell.SessionIDParams(), "token"),
+	})
+	got, err := n.NormalizeString(u)
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if want := "http://x/page"; got != want {
+		t.Errorf("expected %q; got %q", want, got)
+	}
+	n = purell.NewNormalizer(&purell.Options{
+		Flags:           purell.FlagRemoveSessionIDParams,
+		SessionIDParams: []string{},
+	})
+	if got, _ := n.NormalizeString(u); got != u {
+		t.Errorf("expected %q with no session id params; got %q", u, got)
+	}
+}
+
+// The two following benchmarks compare the transforms precomputed
+// by NewNormalizer with the scan of all the transforms, which is done
+// when the flags are changed after construction.
+
+func BenchmarkNormalizerNormalizeURL(b *testing.B) {
+	benchmarkNormalizerNormalizeURL(b, purell.NewNormalizer(&purell.Options{
+		Flags: purell.FlagLowercaseHost,
+	}))
+}
+
+func BenchmarkNormalizerNormalizeURLScan(b *testing.B) {
+	n := purell.NewNormalizer(nil)
+	n.Options().Flags = purell.FlagLowercaseHost
+	benchmarkNormalizerNormalizeURL(b, n)
+}
+
+func benchmarkNormalizerNormalizeURL(b *testing.B, n *purell.Normalizer) {
+	u0, err := url.Parse("http://Example.com/a")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u := *u0
+		n.NormalizeURL(&u)
+	}
+}
+
+func TestNormalizerOptionsFlagsChange(t *testing.T) {
+	n := purell.NewNormalizer(&purell.Options{Flags: purell.FlagLowercaseHost})
+	c := n.Clone()
+	c.Options().Flags |= purell.FlagRemoveFragment
+	const u = "http://EXAMPLE.com/#frag"
+	if got, _ := n.NormalizeString(u); got != "http://example.com/#frag" {
+		t.Errorf("original normalizer: got %q", got)
+	}
+	if got, _ := c.NormalizeString(u); got != "http://example.com/" {
+		t.Errorf("clone with changed flags: got %q", got)
+	}
+}
+
+func TestFreezeComponents(t *testing.T) {
+	for _, test := range []struct {
+		freeze []purell.Component
+		url    string
+		expect string
+	}{{
+		[]purell.Component{purell.ComponentQuery},
+		"http://EXAMPLE.com/a/./b/../c?b=%7e&a=1&&#Frag%7e",
+		"http://example.com/a/c?b=%7e&a=1&&",
+	}, {
+		[]purell.Component{purell.ComponentQuery, purell.ComponentFragment},
+		"http://EXAMPLE.com/a/./b/../c?b=%7e&a=1#Frag%7e",
+		"http://example.com/a/c?b=%7e&a=1#Frag%7e",
+	}, {
+		[]purell.Component{purell.ComponentPath},
+		"http://EXAMPLE.com/a/./b/../c?b=%7e&a=1#Frag",
+		"http://example.com/a/./b/../c?a=1&b=~",
+	}, {
+		[]purell.Component{purell.ComponentQuery},
+		"http://EXAMPLE.com/?",
+		"http://example.com?",
+	}, {
+		// The host must not be taken from the frozen path.
+		[]purell.Component{purell.ComponentPath},
+		"http:///a/b",
+		"http:///a/b",
+	}, {
+		[]purell.Component{purell.ComponentQuery},
+		"http:///a/b",
+		"http://a/b",
+	}} {
+		n := purell.NewNormalizer(&purell.Options{
+			Flags:            purell.FlagsUnsafe | purell.FlagNormalizeEmptyAuthority,
+			FreezeComponents: test.freeze,
+			EscapeCase:       map[purell.Component]purell.CaseChoice{purell.ComponentQuery: purell.CaseUpper},
+		})
+		got, err := n.NormalizeString(test.url)
+		if err != nil {
+			t.Errorf("normalizing %q: %v", test.url, err)
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("normalizing %q, freezing %v: expected %q; got %q", test.url, test.freeze, test.expect, got)
+		}
+	}
+}
+
+func TestNormalizeAll(t *testing.T) {
+	n := purell.NewCachedNormalizer(&purell.Options{Flags: purell.FlagsUnsafe}, 16)
+	var urls, want []string
+	for _, test := range tests {
+		if test.flags != purell.FlagsUnsafe {
+			continue
+		}
+		urls = append(urls, test.url)
+		want = append(want, test.expect)
+	}
+	urls = append(urls, "http://x:y/")
+	want = append(want, "")
+	for _, workers := range []int{0, 1, 4, 1000} {
+		got, errs := n.NormalizeAll(urls, workers)
+		if len(got) != len(urls) || len(errs) != len(urls) {
+			t.Fatalf("with %d workers: expected %d results; got %d and %d errors", workers, len(urls), len(got), len(errs))
+		}
+		for i := range urls {
+			if got[i] != want[i] {
+				t.Errorf("with %d workers, normalizing url %q: expected %q; got %q", workers, urls[i], want[i], got[i])
+			}
+			if wantErr := i == len(urls)-1; (errs[i] != nil) != wantErr {
+				t.Errorf("with %d workers, normalizing url %q: unexpected error %v", workers, urls[i], errs[i])
+			}
+		}
+	}
+	if got, errs := n.NormalizeAll(nil, 4); len(got) != 0 || len(errs) != 0 {
+		t.Errorf("expected no results for no urls; got %q, %v", got, errs)
+	}
+}
@@ -6,51 +6,399 @@ package purell
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
 	"net/url"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 )
 
 // A set of normalization flags determines how a URL will
 // be normalized.
-type NormalizationFlags int
+type NormalizationFlags uint64
 
 const (
 	// Safe normalizations
-	LowercaseScheme Normalizations = 1 << iota
-	LowercaseHost
-	UppercaseEscapes
-	DecodeUnnecessaryEscapes
-	RemoveDefaultPort
-	RemoveEmptyQuerySeparator
+	FlagLowercaseScheme NormalizationFlags = 1 << iota
+	FlagLowercaseHost
+	FlagUppercaseEscapes
+	FlagDecodeUnnecessaryEscapes
+	FlagRemoveDefaultPort
+	FlagRemoveEmptyQuerySeparator
 
 	// Usually safe normalizations
-	RemoveTrailingSlash // Should choose one or the other (in add-remove slash)
-	AddTrailingSlash
-	RemoveDotSegments
+	FlagRemoveTrailingSlash // Should choose one or the other (in add-remove slash)
+	FlagAddTrailingSlash
+	FlagRemoveDotSegments
 
 	// Unsafe normalizations
-	RemoveDirectoryIndex
-	RemoveFragment
-	ForceHttp
-	RemoveDuplicateSlashes
-	RemoveWWW // Should choose one or the other (in add-remove www)
-	AddWWW
-	SortQuery
+	FlagRemoveDirectoryIndex
+	FlagRemoveFragment
+	FlagForceHttp
+	FlagRemoveDuplicateSlashes
+	FlagRemoveWWW // Should choose one or the other (in add-remove www)
+	FlagAddWWW
+	FlagSortQuery
+
+	// Opt-in normalizations, not part of any flag group
+
+	// FlagNormalizeEmptyAuthority treats the first path segment of an
+	// http or https URL with an empty authority as its host, as
+	// browsers do (http:///a -> http://a/).
+	FlagNormalizeEmptyAuthority
+
+	// FlagCollapseHostDots collapses consecutive dots in the host
+	// (a..b.com -> a.b.com). Such hosts are malformed, and there is
+	// no guarantee that the collapsed host refers to the same
+	// resource, so use with care. IPv6 literals are left untouched.
+	FlagCollapseHostDots
+
+	// FlagLowercaseHostASCII lowercases only the ASCII letters of the
+	// host. Unlike FlagLowercaseHost, which applies full Unicode case
+	// mapping, it leaves non-ASCII letters untouched.
+	FlagLowercaseHostASCII
+
+	// FlagRemoveRedundantQuestionMarkAndAmpersand treats any ? in the
+	// query as a & separator, and removes empty separators
+	// (?a=1?b=2 -> ?a=1&b=2, ??a=1&&b=2& -> ?a=1&b=2). By default, as
+	// specified by RFC 3986, a ? in the query is a literal character.
+	FlagRemoveRedundantQuestionMarkAndAmpersand
+
+	// FlagCanonicalizeBlankPathWithQuery adds a / path to URLs that
+	// have a host and a query but no path (http://x?a=1 ->
+	// http://x/?a=1).
+	FlagCanonicalizeBlankPathWithQuery
+
+	// FlagSortMatrixParams sorts the matrix parameters of each path
+	// segment and removes duplicate ones (/a;z=1;a=2;z=1/b ->
+	// /a;a=2;z=1/b).
+	FlagSortMatrixParams
+
+	// FlagEncodeQuerySpacesAsPlus encodes spaces in the query as +,
+	// whether they are literal or encoded as %20 (?a=b%20c ->
+	// ?a=b+c). The path is left untouched.
+	FlagEncodeQuerySpacesAsPlus
+
+	// FlagRemoveDuplicateQueryKeysKeepLast removes all but the last
+	// value of each repeated query key (?a=1&a=2&a=3 -> ?a=3), for
+	// servers that honor the last value only.
+	FlagRemoveDuplicateQueryKeysKeepLast
+
+	// FlagDecodePercentEncodedDotSegments decodes the escaped dots and
+	// slashes of the path (%2e and %2f) before dot segments are
+	// removed, so that encoded traversals are collapsed as well
+	// (/a/%2e%2e%2fb -> /b with FlagRemoveDotSegments). As an encoded
+	// slash is not a path separator, this may change the resource the
+	// URL refers to: only use it when the server decodes them too.
+	FlagDecodePercentEncodedDotSegments
+
+	// FlagLowercaseEscapes lowercases the hexadecimal digits of escapes
+	// (%3F -> %3f), for systems that require it. RFC 3986 recommends
+	// upper case: if FlagUppercaseEscapes is also set, FlagLowercaseEscapes
+	// takes precedence. It applies to the path, the query and the fragment:
+	// the escapes of the host and of the user information are always
+	// written in upper case by the url package.
+	FlagLowercaseEscapes
+
+	// FlagNormalizeMailto trims the whitespace, literal or encoded,
+	// around the addresses of mailto URLs and lowercases their domain
+	// (mailto: User@EXAMPLE.com -> mailto:User@example.com). The local
+	// part of the addresses is left untouched.
+	FlagNormalizeMailto
+
+	// FlagRemoveFragmentDirectives removes the fragment directives,
+	// such as text fragments, that browsers add after :~: in the
+	// fragment (#section:~:text=hello -> #section).
+	FlagRemoveFragmentDirectives
+
+	// FlagNormalizeDataURIMediaType canonicalizes the media type of data
+	// URLs: the type, subtype and parameter names are lowercased, the
+	// parameters are sorted, and the default text/plain;charset=US-ASCII
+	// is made explicit (data:TEXT/Plain;Charset=utf-8,Hi ->
+	// data:text/plain;charset=utf-8,Hi).
+	FlagNormalizeDataURIMediaType
+
+	// FlagCanonicalizeQuery rewrites the query in a canonical form: each
+	// key and value is decoded and re-encoded uniformly (upper case
+	// escapes, spaces as %20), the parameters are sorted by key and then
+	// by value, and duplicate parameters and empty separators are removed.
+	FlagCanonicalizeQuery
+
+	// FlagCollapseConsecutiveAmpersands collapses consecutive & separators
+	// in the query (?a=1&&&b=2 -> ?a=1&b=2). Parameters with empty values,
+	// such as a= in ?a=&b=, are left untouched.
+	FlagCollapseConsecutiveAmpersands
+
+	// FlagNormalizeWindowsDriveLetter uppercases the Windows drive letter
+	// of file URL paths and replaces the legacy | separator by a colon
+	// (file:///c|/x -> file:///C:/x).
+	FlagNormalizeWindowsDriveLetter
+
+	// FlagNormalizeNestedOrigin normalizes the origin of the URL embedded
+	// in blob and filesystem URLs: its scheme and host are lowercased and
+	// its default port is removed (blob:HTTPS://X.com:443/id ->
+	// blob:https://x.com/id).
+	FlagNormalizeNestedOrigin
+
+	// FlagRemoveZeroWidthCharacters removes the zero-width and other
+	// invisible format characters (Unicode category Cf) from the host
+	// and the path, as used to obfuscate phishing URLs
+	// (exa\u200bmple.com -> example.com).
+	FlagRemoveZeroWidthCharacters
+
+	// FlagSortQueryArrayIndices sorts the query parameters like
+	// FlagSortQuery, but orders the numeric indices of array parameters
+	// numerically rather than lexically (?a[2]=x&a[10]=y&a[1]=z ->
+	// ?a[1]=z&a[2]=x&a[10]=y). The encoding of the query is preserved.
+	FlagSortQueryArrayIndices
+
+	// FlagDecodeTrailingEncodedSlash decodes a trailing escaped slash of
+	// the path (/a%2f -> /a/). By default, the escaped form is preserved,
+	// as an escaped slash is not a path separator.
+	FlagDecodeTrailingEncodedSlash
+
+	// FlagRemoveUserInfo removes the user information (http://u:p@x/ ->
+	// http://x/). Combined with FlagRemovePort, it allows comparing
+	// endpoints regardless of credentials and port.
+	FlagRemoveUserInfo
+
+	// FlagRemovePort removes the port, whether it is the default one
+	// or not (http://x:8443/ -> http://x/).
+	FlagRemovePort
+
+	// FlagNormalizeQuerySemicolonToAmpersand rewrites the legacy ; query
+	// separator to & (?a=1;b=2 -> ?a=1&b=2). Encoded semicolons (%3B), which
+	// are part of a key or value, are left untouched.
+	FlagNormalizeQuerySemicolonToAmpersand
+
+	// FlagRemoveEmptyFragmentSeparator removes a # followed by an empty
+	// fragment (http://x/# -> http://x/). It only names existing
+	// behaviour: it is always implicitly applied, whether set or not,
+	// because url.URL does not record an empty fragment.
+	FlagRemoveEmptyFragmentSeparator
+
+	// FlagNormalizeURN lowercases the scheme and the namespace identifier
+	// of urn URIs, which are case-insensitive according to RFC 8141
+	// (URN:ISBN:0451450523 -> urn:isbn:0451450523). The namespace-specific
+	// string is left untouched.
+	FlagNormalizeURN
+
+	// FlagRemoveSchemeSeparatorSpaces repairs malformed URL strings by
+	// removing the whitespace inside the scheme and around the :// that
+	// follows it (http :// x.com -> http://x.com). It only applies to URL
+	// strings, before they are parsed.
+	FlagRemoveSchemeSeparatorSpaces
+
+	// FlagDecodeQueryThenReencodeCanonical decodes each query key and value
+	// and re-encodes it minimally, escaping only the characters that are not
+	// allowed in a query or that would change its structure, such as & and =
+	// (?a=foo%2Dbar%3F%26 -> ?a=foo-bar?%26). Spaces, literal or encoded as +,
+	// are encoded as %20. The order of the parameters is preserved.
+	FlagDecodeQueryThenReencodeCanonical
+
+	// FlagRemoveRedundantEncodedUnreservedInFragment decodes the
+	// percent-encoded unreserved characters of the fragment only
+	// (#%7Eprofile -> #~profile), leaving those of the other components
+	// alone. Reserved characters stay encoded. FlagDecodeUnnecessaryEscapes
+	// already applies to the fragment, among other components.
+	FlagRemoveRedundantEncodedUnreservedInFragment
+
+	// FlagCanonicalizeIPv4MappedIPv6 converts IPv4-mapped IPv6 hosts to
+	// their dotted-decimal IPv4 form ([::ffff:192.168.0.1] -> 192.168.0.1).
+	// Other IPv6 hosts are left untouched.
+	FlagCanonicalizeIPv4MappedIPv6
+
+	// FlagEncodeHostPunycode converts the hosts holding non-ASCII characters,
+	// whether literal or percent-encoded as UTF-8, to their IDNA punycode
+	// form (http://%E4%BE%8B.test/ -> http://xn--fsq.test/). Hosts that are
+	// not valid internationalized domain names are left untouched.
+	FlagEncodeHostPunycode
+
+	// FlagSortQueryPreserveFirstKeyPosition sorts the values of each query key,
+	// grouping them at the position of the first appearance of the key, but
+	// keeps the keys in their order of appearance (?b=2&a=1&b=1 ->
+	// ?b=1&b=2&a=1). The parameters are not re-encoded. FlagSortQuery, which
+	// also sorts the keys, takes precedence.
+	FlagSortQueryPreserveFirstKeyPosition
+
+	// FlagRemoveTrackingParams removes the query parameters commonly used to
+	// track visitors, such as the utm_* ones of Google Analytics and the
+	// click identifiers of advertising platforms (fbclid, gclid...), whose
+	// keys are listed by TrackingParams. Empty parameters are removed too.
+	FlagRemoveTrackingParams
+
+	// FlagNormalizeTrailingDotInPathSegments strips the trailing dots of the
+	// path segments (/file./x -> /file/x), which some file systems, such as
+	// Windows ones, ignore. It is very site-specific, and meaningless for
+	// most servers. The . and .. segments, and other segments made only of
+	// dots, are left untouched.
+	FlagNormalizeTrailingDotInPathSegments
+
+	// FlagRemoveSessionIDParams removes the session identifiers, such as
+	// jsessionid or phpsessid, from the query and from the parameters of
+	// the path segments (/page;jsessionid=ABC?phpsessid=XYZ -> /page). Their
+	// keys, compared case-insensitively, are listed by SessionIDParams, and
+	// may be changed with Options.SessionIDParams.
+	FlagRemoveSessionIDParams
+
+	// FlagForceWSS forces the secure wss scheme for the ws WebSocket URLs.
+	// An explicit port equal to the default port of ws is replaced by the
+	// default port of wss (ws://x:80/ -> wss://x:443/), which
+	// FlagRemoveDefaultPort may then remove.
+	FlagForceWSS
+
+	// FlagLowercaseQueryEscapes is like FlagLowercaseEscapes, but only
+	// lowercases the escapes of the query (?q=%3F -> ?q=%3f), leaving
+	// those of the path and the fragment in upper case.
+	FlagLowercaseQueryEscapes
+
+	// FlagRemoveDefaultPortOnForce, along with FlagForceHttp or
+	// FlagForceWSS, removes an explicit port equal to the default port of
+	// the scheme they replace (https://x:443 -> http://x), which would
+	// otherwise be wrong for the new scheme. It has no effect on its own.
+	FlagRemoveDefaultPortOnForce
+
+	// FlagTrimQueryValueSpaces trims the leading and trailing white space,
+	// whether literal or encoded as %20 or +, of all the query values
+	// (?q=%20hello+&a=1 -> ?q=hello&a=1). Options.TrimQueryValues does
+	// the same for given keys only.
+	FlagTrimQueryValueSpaces
+
+	// FlagRemoveEmptyQueryPairs removes the query pairs that have neither
+	// a key nor a value, whatever the separators around them
+	// (?&a=1&&=&b=2& -> ?a=1&b=2).
+	FlagRemoveEmptyQueryPairs
+
+	// FlagNormalizeUnicodeHostNFC converts the hosts holding non-ASCII
+	// characters to their Unicode normalization form C, so that decomposed
+	// and precomposed hosts compare equal (café.com -> café.com).
+	// FlagEncodeHostPunycode applies it too, as part of the IDNA mapping.
+	FlagNormalizeUnicodeHostNFC
+
+	// FlagSortQueryNestedKeys sorts the query parameters by their nested
+	// keys, as parsed by PHP or Rails: by name, then bracket by bracket,
+	// with numeric indices ordered numerically (?a[b][y]=1&a[a]=2&a[b][x]=3
+	// -> ?a[a]=2&a[b][x]=3&a[b][y]=1). Parameters with the same key, such
+	// as the elements of a[], keep their relative order, which matters to
+	// these frameworks. The encoding of the query is preserved.
+	FlagSortQueryNestedKeys
+
+	// FlagNormalizeViewSource normalizes the URL inside view-source: URLs
+	// with the other flags, keeping the prefix (view-source:HTTPS://X/ ->
+	// view-source:https://x/). Otherwise, view-source: URLs are opaque.
+	FlagNormalizeViewSource
+
+	// FlagRemoveViewSource removes the view-source: prefix of URLs and
+	// normalizes the URL inside with the other flags
+	// (view-source:HTTPS://X/ -> https://x/).
+	FlagRemoveViewSource
+
+	// FlagRemoveTrailingQueryAmpersands removes the & separators at the end
+	// of the query (?a=1&& -> ?a=1). Unlike FlagCollapseConsecutiveAmpersands,
+	// it leaves the other separators untouched.
+	FlagRemoveTrailingQueryAmpersands
 
 	// Flag groups.
-	Safe = LowercaseHost | LowercaseScheme | UppercaseEscapes | DecodeUnnecessaryEscapes | RemoveDefaultPort | RemoveEmptyQuerySeparator
+	FlagsSafe = FlagLowercaseHost | FlagLowercaseScheme | FlagUppercaseEscapes | FlagDecodeUnnecessaryEscapes | FlagRemoveDefaultPort | FlagRemoveEmptyQuerySeparator
+
+	FlagsUsuallySafe = FlagsSafe | FlagRemoveTrailingSlash | FlagRemoveDotSegments
+
+	FlagsUnsafe = FlagsUsuallySafe | FlagRemoveDirectoryIndex | FlagRemoveFragment | FlagForceHttp | FlagRemoveDuplicateSlashes | FlagRemoveWWW | FlagSortQuery
 
-	UsuallySafe = sSafe | RemoveTrailingSlash | RemoveDotSegments
+	// FlagRemoveQueryIfOnlyTrackingParams removes the tracking query
+	// parameters and, if no other parameter is left, the whole query,
+	// including the ? separator.
+	FlagRemoveQueryIfOnlyTrackingParams = FlagRemoveTrackingParams | FlagRemoveEmptyQuerySeparator
 
-	Unsafe = UsuallySafe | RemoveDirectoryIndex | RemoveFragment | ForceHttp | RemoveDuplicateSlashes | RemoveWWW | SortQuery
+	// FlagTidyQuery tidies messy queries: it is the sum of
+	// FlagCollapseConsecutiveAmpersands, FlagRemoveTrailingQueryAmpersands,
+	// FlagRemoveEmptyQueryPairs, FlagTrimQueryValueSpaces and
+	// FlagEncodeQuerySpacesAsPlus (?&&q=+a%20b+&&=& -> ?q=a+b).
+	FlagTidyQuery = FlagCollapseConsecutiveAmpersands | FlagRemoveTrailingQueryAmpersands | FlagRemoveEmptyQueryPairs | FlagTrimQueryValueSpaces | FlagEncodeQuerySpacesAsPlus
 )
 
-var rxPort = regexp.MustCompile(`(:\d+)/?$`)
+// FlagNone holds no normalization: NormalizeURL(u, FlagNone)
+// leaves u unchanged. It is the zero value of NormalizationFlags.
+const FlagNone NormalizationFlags = 0
+
+// usuallySafeFlags holds all the normalizations that are at most
+// usually safe. FlagAddTrailingSlash, FlagLowercaseEscapes and
+// FlagLowercaseQueryEscapes are not part of FlagsUsuallySafe only
+// because they conflict with FlagRemoveTrailingSlash and
+// FlagUppercaseEscapes, and FlagLowercaseHostASCII and
+// FlagRemoveRedundantEncodedUnreservedInFragment only because they
+// are weaker variants of FlagLowercaseHost and
+// FlagDecodeUnnecessaryEscapes. FlagNormalizeURN,
+// FlagNormalizeUnicodeHostNFC and FlagNormalizeViewSource only apply
+// to urn URIs, to internationalized hosts and to view-source URLs.
+// FlagRemoveEmptyFragmentSeparator is always applied anyway.
+const usuallySafeFlags = FlagsUsuallySafe | FlagRemoveEmptyFragmentSeparator | FlagAddTrailingSlash | FlagLowercaseHostASCII | FlagLowercaseEscapes | FlagLowercaseQueryEscapes | FlagNormalizeURN | FlagNormalizeUnicodeHostNFC | FlagNormalizeViewSource | FlagRemoveRedundantEncodedUnreservedInFragment
+
+// IsSafe reports whether f holds only safe or usually safe
+// normalizations, that is, normalizations that should not
+// cause two distinct resources to be considered equivalent.
+func IsSafe(f NormalizationFlags) bool {
+	return UnsafeFlags(f) == 0
+}
+
+// UnsafeFlags returns the subset of f that holds unsafe
+// normalizations.
+func UnsafeFlags(f NormalizationFlags) NormalizationFlags {
+	return f &^ usuallySafeFlags
+}
+
+// defaultPorts holds the default port of each scheme, as used
+// by FlagRemoveDefaultPort. It is guarded by defaultPortsMu.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+var defaultPortsMu sync.RWMutex
+
+// RegisterDefaultPort registers port as the default port of the
+// given scheme, compared case-insensitively, so that FlagRemoveDefaultPort
+// removes it, for example 21 for ftp or 22 for sftp. It replaces
+// any previously registered default port of the scheme.
+func RegisterDefaultPort(scheme string, port int) {
+	defaultPortsMu.Lock()
+	defer defaultPortsMu.Unlock()
+	defaultPorts[strings.ToLower(scheme)] = strconv.Itoa(port)
+}
+
+// UnregisterDefaultPort unregisters the default port of the
+// given scheme, so that FlagRemoveDefaultPort keeps it.
+func UnregisterDefaultPort(scheme string) {
+	defaultPortsMu.Lock()
+	defer defaultPortsMu.Unlock()
+	delete(defaultPorts, strings.ToLower(scheme))
+}
+
+// defaultPort returns the default port of the given
+// lowercase scheme, if any.
+func defaultPort(scheme string) (string, bool) {
+	defaultPortsMu.RLock()
+	defer defaultPortsMu.RUnlock()
+	port, ok := defaultPorts[scheme]
+	return port, ok
+}
+
+var rxPort = regexp.MustCompile(`(:\d*)/?$`)
 var rxDirIndex = regexp.MustCompile(`(^|/)((?:default|index)\.\w{1,4})$`)
 var rxDupSlashes = regexp.MustCompile(`/{2,}`)
+var rxDupDots = regexp.MustCompile(`\.{2,}`)
+var rxDriveLetter = regexp.MustCompile(`^/([a-zA-Z])(?::|\||%7[cC])(/|$)`)
+var rxDupAmpersands = regexp.MustCompile(`&{2,}`)
+var rxSchemeSeparator = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.\-\s]*?)\s*:\s*//\s*`)
 
 // MustNormalizeURLString returns the normalized URL as a string. It panics if
 // the URL cannot be parsed.
@@ -65,7 +413,7 @@ func MustNormalizeURLString(u string, f NormalizationFlags) string {
 // NormalizeURLString returns the returns the normalized URL as
 // as a string.
 func NormalizeURLString(u string, f NormalizationFlags) (string, error) {
-	parsed, err := url.Parse(u)
+	parsed, err := parse(u, f)
 	if err != nil {
 		return "", err
 	}
@@ -73,28 +421,206 @@ func NormalizeURLString(u string, f NormalizationFlags) (string, error) {
 	return parsed.String(), nil
 }
 
-var transforms = []struct {
-	flag      NormalizationFlags
-	normalize func(*url.URL)
-}{
+// SplitFragment is like NormalizeURLString except that the fragment
+// is removed from the normalized URL and returned separately, in its
+// original escaped form and without the # separator, for instance to
+// be stored out of band. The normalizations of f apply to the rest
+// of the URL only.
+func SplitFragment(rawurl string, f NormalizationFlags) (normalized, fragment string, err error) {
+	u, err := parse(rawurl, f)
+	if err != nil {
+		return "", "", err
+	}
+	fragment = u.EscapedFragment()
+	removeFragment(u)
+	NormalizeURL(u, f)
+	return u.String(), fragment, nil
+}
+
+// NormalizeURLStringWithBase is like NormalizeURLString except that
+// u may be relative, in which case it is first resolved against
+// the base URL. The base is ignored when u is absolute.
+func NormalizeURLStringWithBase(base, u string, f NormalizationFlags) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	ref, err := parse(u, f)
+	if err != nil {
+		return "", err
+	}
+	resolved := b.ResolveReference(ref)
+	NormalizeURL(resolved, f)
+	return resolved.String(), nil
+}
+
+// NormalizedHash returns the 64-bit FNV-1a hash of the normalized
+// URL. Equivalent URLs under f have the same hash, and the hash
+// does not change between runs, so it may be persisted.
+func NormalizedHash(rawurl string, f NormalizationFlags) (uint64, error) {
+	s, err := NormalizeURLString(rawurl, f)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	io.WriteString(h, s)
+	return h.Sum64(), nil
+}
+
+// hostFlags holds the normalizations that affect the host. Only the
+// host part of FlagRemoveZeroWidthCharacters applies to an authority.
+const hostFlags = FlagRemoveZeroWidthCharacters | FlagLowercaseHost | FlagLowercaseHostASCII | FlagCollapseHostDots | FlagCanonicalizeIPv4MappedIPv6 | FlagNormalizeUnicodeHostNFC | FlagEncodeHostPunycode | FlagRemoveDefaultPort | FlagRemovePort | FlagRemoveWWW | FlagAddWWW
+
+// queryFlags holds the normalizations that only affect the query.
+const queryFlags = FlagRemoveEmptyQuerySeparator | FlagSortQuery | FlagRemoveRedundantQuestionMarkAndAmpersand | FlagEncodeQuerySpacesAsPlus | FlagRemoveDuplicateQueryKeysKeepLast | FlagCanonicalizeQuery | FlagCollapseConsecutiveAmpersands | FlagSortQueryArrayIndices | FlagLowercaseQueryEscapes | FlagNormalizeQuerySemicolonToAmpersand | FlagDecodeQueryThenReencodeCanonical | FlagSortQueryPreserveFirstKeyPosition | FlagRemoveTrackingParams | FlagTrimQueryValueSpaces | FlagRemoveEmptyQueryPairs | FlagSortQueryNestedKeys | FlagRemoveTrailingQueryAmpersands
+
+// NormalizeAuthority normalizes the given host, with an optional
+// port, as it would be in a URL with the given scheme. Only the
+// host-related normalizations in f are applied.
+func NormalizeAuthority(host string, scheme string, f NormalizationFlags) string {
+	if f&FlagDecodeUnnecessaryEscapes == FlagDecodeUnnecessaryEscapes && !strings.HasPrefix(host, "[") {
+		host = decodeUnreserved(host)
+	}
+	u := &url.URL{Scheme: scheme, Host: host}
+	NormalizeURL(u, f&hostFlags)
+	return u.Host
+}
+
+// originFlags holds the normalizations that affect the origin
+// of a URL, that is its scheme, host and port.
+const originFlags = hostFlags | FlagLowercaseScheme | FlagForceHttp | FlagForceWSS | FlagRemoveDefaultPortOnForce
+
+// NormalizedOrigin returns the normalized origin of the given URL
+// string, in the form scheme://host[:port]. Only the normalizations
+// in f that affect the scheme, the host or the port are applied, and
+// the user information, path, query and fragment are dropped.
+func NormalizedOrigin(rawurl string, f NormalizationFlags) (string, error) {
+	u, err := parse(rawurl, f)
+	if err != nil {
+		return "", err
+	}
+	if len(u.Host) == 0 {
+		return "", &url.Error{Op: "origin", URL: rawurl, Err: errors.New("missing host")}
+	}
+	u = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	NormalizeURL(u, f&originFlags)
+	return u.String(), nil
+}
+
+// parse parses the URL string s, first applying the normalizations
+// in f that cannot be applied to a parsed URL.
+func parse(s string, f NormalizationFlags) (*url.URL, error) {
+	if f&FlagRemoveSchemeSeparatorSpaces == FlagRemoveSchemeSeparatorSpaces {
+		s = removeSchemeSeparatorSpaces(s)
+	}
+	if f&FlagDecodeUnnecessaryEscapes == FlagDecodeUnnecessaryEscapes {
+		// The url package rejects escaped ASCII in hosts,
+		// so they must be decoded before parsing.
+		s = decodeHostEscapes(s)
+	}
+	return url.Parse(s)
+}
+
+func removeSchemeSeparatorSpaces(s string) string {
+	m := rxSchemeSeparator.FindStringSubmatchIndex(s)
+	if m == nil {
+		return s
+	}
+	scheme := strings.Join(strings.Fields(s[m[2]:m[3]]), "")
+	return scheme + "://" + s[m[1]:]
+}
+
+// transforms holds the normalizations in the order they are applied.
+// The host is handled in three steps: its unnecessary escapes are
+// decoded first (by parse, since the url package rejects them), then
+// it is lowercased, and its remaining escapes are finally written in
+// upper case by url.URL.String. Thus EX%41MPLE.com normalizes to
+// example.com, whatever the order of the flags.
+var transforms = []transform{
+	{FlagNormalizeEmptyAuthority, normalizeEmptyAuthority}, // Must be before host transforms
+	{FlagRemoveZeroWidthCharacters, removeZeroWidthCharacters},
 	{FlagLowercaseScheme, lowercaseScheme},
+	{FlagNormalizeMailto, normalizeMailto},
+	{FlagNormalizeURN, normalizeURN},
+	{FlagNormalizeDataURIMediaType, normalizeDataURIMediaType},
+	{FlagNormalizeNestedOrigin, normalizeNestedOrigin},
 	{FlagLowercaseHost, lowercaseHost},
-	{FlagRemoveDefaultPort, removeDefaultPort},
+	{FlagLowercaseHostASCII, lowercaseHostASCII},
+	{FlagCollapseHostDots, collapseHostDots},
+	{FlagCanonicalizeIPv4MappedIPv6, canonicalizeIPv4MappedIPv6}, // Must be before remove default port
+	{FlagNormalizeUnicodeHostNFC, normalizeUnicodeHostNFC},
+	{FlagEncodeHostPunycode, encodeHostPunycode}, // Must be before www transforms
+	{FlagDecodeUnnecessaryEscapes, decodeUnnecessaryEscapes},
+	{FlagRemoveRedundantEncodedUnreservedInFragment, decodeFragmentUnreserved},
+	{FlagUppercaseEscapes, uppercaseEscapes},                                     // Must be after decode unnecessary escapes
+	{FlagDecodeTrailingEncodedSlash, decodeTrailingEncodedSlash},                 // Must be before trailing slash transforms
+	{FlagNormalizeTrailingDotInPathSegments, normalizeTrailingDotInPathSegments}, // Must be before directory index and trailing slash transforms
 	{FlagRemoveTrailingSlash, removeTrailingSlash},
 	{FlagRemoveDirectoryIndex, removeDirectoryIndex}, // Must be before add trailing slash
 	{FlagAddTrailingSlash, addTrailingSlash},
+	{FlagDecodePercentEncodedDotSegments, decodePercentEncodedDotSegments}, // Must be before remove dot segments
 	{FlagRemoveDotSegments, removeDotSegments},
+	{FlagNormalizeWindowsDriveLetter, normalizeWindowsDriveLetter},
+	{FlagCanonicalizeBlankPathWithQuery, canonicalizeBlankPathWithQuery},
 	{FlagRemoveFragment, removeFragment},
+	{FlagRemoveFragmentDirectives, removeFragmentDirectives},
+	{FlagForceHttp | FlagRemoveDefaultPortOnForce, forceHttpRemovingPort}, // Must be before force http
 	{FlagForceHttp, forceHttp},
+	{FlagForceWSS | FlagRemoveDefaultPortOnForce, forceWSSRemovingPort}, // Must be before force wss
+	{FlagForceWSS, forceWSS},
+	{FlagRemoveDefaultPort, removeDefaultPort}, // Must be after force http and force wss
+	{FlagRemovePort, removePort},
+	{FlagRemoveUserInfo, removeUserInfo},
 	{FlagRemoveDuplicateSlashes, removeDuplicateSlashes},
+	{FlagSortMatrixParams, sortMatrixParams},
 	{FlagRemoveWWW, removeWWW},
 	{FlagAddWWW, addWWW},
+	{FlagNormalizeQuerySemicolonToAmpersand, normalizeQuerySemicolonToAmpersand},           // Must be before sort query
+	{FlagRemoveTrackingParams, removeTrackingParams},                                       // Must be before sort query
+	{FlagRemoveSessionIDParams, removeSessionIDParams},                                     // Must be before sort query
+	{FlagRemoveRedundantQuestionMarkAndAmpersand, removeRedundantQuestionMarkAndAmpersand}, // Must be before sort query
+	{FlagRemoveDuplicateQueryKeysKeepLast, removeDuplicateQueryKeysKeepLast},               // Must be before sort query
+	{FlagCollapseConsecutiveAmpersands, collapseConsecutiveAmpersands},
+	{FlagRemoveTrailingQueryAmpersands, removeTrailingQueryAmpersands},
+	{FlagTrimQueryValueSpaces, trimQueryValueSpaces}, // Must be before remove empty query pairs
+	{FlagRemoveEmptyQueryPairs, removeEmptyQueryPairs},
+	{FlagSortQueryPreserveFirstKeyPosition, sortQueryValues}, // Must be before sort query
 	{FlagSortQuery, sortQuery},
+	{FlagCanonicalizeQuery, canonicalizeQuery},
+	{FlagDecodeQueryThenReencodeCanonical, reencodeQuery},      // Must be after sort query
+	{FlagSortQueryArrayIndices, sortQueryArrayIndices},         // Must be after sort query
+	{FlagSortQueryNestedKeys, sortQueryNestedKeys},             // Must be after sort query
+	{FlagEncodeQuerySpacesAsPlus, encodeQuerySpacesAsPlus},     // Must be after sort query
+	{FlagLowercaseEscapes, lowercaseEscapes},                   // Must be after uppercase escapes and query transforms
+	{FlagLowercaseQueryEscapes, lowercaseQueryEscapes},         // Must be after uppercase escapes and query transforms
+	{FlagRemoveEmptyQuerySeparator, removeEmptyQuerySeparator}, // Must be after query transforms
+}
+
+// transform associates a normalization flag with the function
+// that applies it.
+type transform struct {
+	flag      NormalizationFlags
+	normalize func(*url.URL)
+}
+
+// applicableTransforms returns the transforms applied by f,
+// in order.
+func applicableTransforms(f NormalizationFlags) []transform {
+	var ts []transform
+	for _, t := range transforms {
+		if f&t.flag == t.flag {
+			ts = append(ts, t)
+		}
+	}
+	return ts
 }
 
 // NormalizeURL normalizes the given URL according to the
 // given flags.
 func NormalizeURL(u *url.URL, f NormalizationFlags) {
+	if normalizeViewSource(u, f, func(inner *url.URL) { NormalizeURL(inner, f) }) {
+		return
+	}
 	for _, t := range transforms {
 		if f&t.flag == t.flag {
 			t.normalize(u)
@@ -102,71 +628,434 @@ func NormalizeURL(u *url.URL, f NormalizationFlags) {
 	}
 }
 
+// normalizeViewSource applies normalize to the URL inside u if u
+// is a view-source: URL and f holds FlagNormalizeViewSource or
+// FlagRemoveViewSource, removing the prefix in the latter case.
+// It reports whether it did.
+func normalizeViewSource(u *url.URL, f NormalizationFlags, normalize func(*url.URL)) bool {
+	if f&(FlagNormalizeViewSource|FlagRemoveViewSource) == 0 || !strings.EqualFold(u.Scheme, "view-source") || len(u.Opaque) == 0 {
+		return false
+	}
+	s := u.Opaque
+	if len(u.RawQuery) > 0 || u.ForceQuery {
+		s += "?" + u.RawQuery
+	}
+	if len(u.Fragment) > 0 {
+		s += "#" + u.EscapedFragment()
+	}
+	inner, err := parse(s, f)
+	if err != nil {
+		return false
+	}
+	normalize(inner)
+	if f&FlagRemoveViewSource == FlagRemoveViewSource {
+		*u = *inner
+		return true
+	}
+	if wrapped, err := url.Parse(u.Scheme + ":" + inner.String()); err == nil {
+		*u = *wrapped
+	}
+	return true
+}
+
+// NormalizedCopy is like NormalizeURL except that it returns a
+// normalized copy of u, leaving u untouched.
+func NormalizedCopy(u *url.URL, f NormalizationFlags) *url.URL {
+	c := *u
+	NormalizeURL(&c, f)
+	return &c
+}
+
+// EqualNormalized reports whether a and b are equal once normalized
+// with f. Neither a nor b is modified, and no string round-trip is
+// involved: the normalized copies are compared component by component.
+func EqualNormalized(a, b *url.URL, f NormalizationFlags) bool {
+	return equalURL(NormalizedCopy(a, f), NormalizedCopy(b, f))
+}
+
+func equalURL(a, b *url.URL) bool {
+	return a.Scheme == b.Scheme &&
+		a.Opaque == b.Opaque &&
+		equalUserinfo(a.User, b.User) &&
+		a.Host == b.Host &&
+		a.EscapedPath() == b.EscapedPath() &&
+		a.ForceQuery == b.ForceQuery &&
+		a.RawQuery == b.RawQuery &&
+		a.EscapedFragment() == b.EscapedFragment()
+}
+
+func equalUserinfo(a, b *url.Userinfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	pa, seta := a.Password()
+	pb, setb := b.Password()
+	return a.Username() == b.Username() && pa == pb && seta == setb
+}
+
+func normalizeEmptyAuthority(u *url.URL) {
+	if len(u.Host) > 0 || u.User != nil || len(u.Opaque) > 0 {
+		return
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		// Other schemes, such as file, may legitimately
+		// have an empty authority.
+		return
+	}
+	p := strings.TrimLeft(u.Path, "/")
+	if len(p) == 0 {
+		return
+	}
+	host, path := p, "/"
+	if i := strings.Index(p, "/"); i >= 0 {
+		host, path = p[:i], p[i:]
+	}
+	u.Host = host
+	u.Path = path
+	u.RawPath = ""
+}
+
+func removeZeroWidthCharacters(u *url.URL) {
+	u.Host = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, u.Host)
+	if len(u.Path) > 0 {
+		setEscapedPath(u, removeEscapedFormatCharacters(u.EscapedPath()))
+	}
+}
+
 func lowercaseScheme(u *url.URL) {
 	u.Scheme = strings.ToLower(u.Scheme)
 }
 
+func normalizeMailto(u *url.URL) {
+	if !strings.EqualFold(u.Scheme, "mailto") || len(u.Opaque) == 0 {
+		return
+	}
+	addrs := strings.Split(u.Opaque, ",")
+	for i, addr := range addrs {
+		addr = trimEscapedSpace(addr)
+		if j := strings.LastIndex(addr, "@"); j >= 0 {
+			addr = addr[:j] + strings.ToLower(addr[j:])
+		}
+		addrs[i] = addr
+	}
+	u.Opaque = strings.Join(addrs, ",")
+}
+
+func normalizeURN(u *url.URL) {
+	if !strings.EqualFold(u.Scheme, "urn") || len(u.Opaque) == 0 {
+		return
+	}
+	u.Scheme = "urn"
+	if i := strings.Index(u.Opaque, ":"); i >= 0 {
+		u.Opaque = strings.ToLower(u.Opaque[:i]) + u.Opaque[i:]
+	}
+}
+
+func normalizeDataURIMediaType(u *url.URL) {
+	if !strings.EqualFold(u.Scheme, "data") || len(u.Opaque) == 0 {
+		return
+	}
+	i := strings.Index(u.Opaque, ",")
+	if i < 0 {
+		return
+	}
+	params := strings.Split(u.Opaque[:i], ";")
+	mediaType := strings.ToLower(params[0])
+	if len(mediaType) == 0 {
+		mediaType = "text/plain"
+	}
+	params = params[1:]
+	var base64, hasCharset bool
+	kept := params[:0]
+	for _, p := range params {
+		if strings.EqualFold(p, "base64") {
+			base64 = true
+			continue
+		}
+		if j := strings.Index(p, "="); j >= 0 {
+			p = strings.ToLower(p[:j]) + p[j:]
+		}
+		if strings.HasPrefix(p, "charset=") {
+			hasCharset = true
+		}
+		kept = append(kept, p)
+	}
+	if !hasCharset && mediaType == "text/plain" {
+		kept = append(kept, "charset=US-ASCII")
+	}
+	sort.Strings(kept)
+	if base64 {
+		kept = append(kept, "base64")
+	}
+	u.Opaque = strings.Join(append([]string{mediaType}, kept...), ";") + u.Opaque[i:]
+}
+
+func normalizeNestedOrigin(u *url.URL) {
+	switch strings.ToLower(u.Scheme) {
+	case "blob", "filesystem":
+	default:
+		return
+	}
+	inner, err := url.Parse(u.Opaque)
+	if err != nil || len(inner.Host) == 0 {
+		return
+	}
+	lowercaseScheme(inner)
+	lowercaseHost(inner)
+	removeDefaultPort(inner)
+	u.Opaque = inner.String()
+}
+
+// lowercaseHost lowercases the host of u. The userinfo, held apart
+// in u.User, is left untouched, since user names and passwords are
+// case-sensitive.
 func lowercaseHost(u *url.URL) {
-	u.Host = strings.ToLower(u.Host)
+	u.Host = mapHostExceptZone(u.Host, strings.ToLower)
+}
+
+// mapHostExceptZone applies f to host, leaving any IPv6 zone identifier
+// (as in "[fe80::1%eth0]") untouched, since zones are case-sensitive.
+// The "%25" that introduces the zone is produced by url.URL.String and
+// never reaches f.
+func mapHostExceptZone(host string, f func(string) string) string {
+	if strings.HasPrefix(host, "[") {
+		if i := strings.Index(host, "%"); i >= 0 {
+			if j := strings.Index(host[i:], "]"); j >= 0 {
+				return f(host[:i]) + host[i:i+j] + f(host[i+j:])
+			}
+		}
+	}
+	return f(host)
+}
+
+func canonicalizeIPv4MappedIPv6(u *url.URL) {
+	if !strings.HasPrefix(u.Host, "[") {
+		return
+	}
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil || ip.To4() == nil {
+		// Not an IPv4-mapped address, or one with a zone.
+		return
+	}
+	host := ip.To4().String()
+	if port := u.Port(); len(port) > 0 {
+		host += ":" + port
+	}
+	u.Host = host
+}
+
+func decodeUnnecessaryEscapes(u *url.URL) {
+	mapEscaped(u, decodeUnreserved)
+}
+
+func decodeFragmentUnreserved(u *url.URL) {
+	if len(u.Fragment) > 0 {
+		setEscapedFragment(u, decodeUnreserved(u.EscapedFragment()))
+	}
+}
+
+func uppercaseEscapes(u *url.URL) {
+	mapEscaped(u, uppercaseEscapesString)
+}
+
+func lowercaseEscapes(u *url.URL) {
+	mapEscaped(u, lowercaseEscapesString)
+}
+
+func lowercaseQueryEscapes(u *url.URL) {
+	u.RawQuery = lowercaseEscapesString(u.RawQuery)
+}
+
+func lowercaseHostASCII(u *url.URL) {
+	u.Host = mapHostExceptZone(u.Host, func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if 'A' <= r && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+			return r
+		}, s)
+	})
+}
+
+func collapseHostDots(u *url.URL) {
+	if len(u.Host) > 0 && !strings.HasPrefix(u.Host, "[") {
+		u.Host = rxDupDots.ReplaceAllString(u.Host, ".")
+	}
 }
 
 func removeDefaultPort(u *url.URL) {
 	if len(u.Host) > 0 {
+		scheme := strings.ToLower(u.Scheme)
 		u.Host = rxPort.ReplaceAllStringFunc(u.Host, func(val string) string {
-			if val == ":80" {
-				return ""
+			var slash string
+			if strings.HasSuffix(val, "/") {
+				val, slash = val[:len(val)-1], "/"
 			}
-			return val
+			if len(val) == 1 {
+				// An empty port is equivalent to the default one.
+				return slash
+			}
+			// Strip leading zeros, so that :080 is recognized as :80.
+			port := strings.TrimLeft(val[1:], "0")
+			if len(port) == 0 {
+				port = "0"
+			}
+			if p, ok := defaultPort(scheme); ok && port == p {
+				return slash
+			}
+			return ":" + port + slash
 		})
 	}
 }
 
+func normalizeTrailingDotInPathSegments(u *url.URL) {
+	p := u.EscapedPath()
+	if !strings.Contains(p, ".") {
+		return
+	}
+	segments := strings.Split(p, "/")
+	for i, seg := range segments {
+		if t := strings.TrimRight(seg, "."); len(t) > 0 {
+			segments[i] = t
+		}
+	}
+	setEscapedPath(u, strings.Join(segments, "/"))
+}
+
+func decodeTrailingEncodedSlash(u *url.URL) {
+	if p := u.EscapedPath(); strings.HasSuffix(p, "%2f") || strings.HasSuffix(p, "%2F") {
+		setEscapedPath(u, p[:len(p)-3]+"/")
+	}
+}
+
+func removePort(u *url.URL) {
+	if i := strings.LastIndex(u.Host, ":"); i >= 0 && !strings.Contains(u.Host[i:], "]") {
+		u.Host = u.Host[:i]
+	}
+}
+
+func removeUserInfo(u *url.URL) {
+	u.User = nil
+}
+
 func removeTrailingSlash(u *url.URL) {
-	if l := len(u.Path); l > 0 && strings.HasSuffix(u.Path, "/") {
-		u.Path = u.Path[:l-1]
-	} else if l = len(u.Host); l > 0 && strings.HasSuffix(u.Host, "/") {
+	if p := u.EscapedPath(); strings.HasSuffix(p, "/") {
+		setEscapedPath(u, p[:len(p)-1])
+	} else if l := len(u.Host); l > 0 && strings.HasSuffix(u.Host, "/") {
 		u.Host = u.Host[:l-1]
 	}
 }
 
 func addTrailingSlash(u *url.URL) {
-	if l := len(u.Path); l > 0 && !strings.HasSuffix(u.Path, "/") {
-		u.Path += "/"
-	} else if l = len(u.Host); l > 0 && !strings.HasSuffix(u.Host, "/") {
-		u.Host += "/"
+	if p := u.EscapedPath(); len(p) > 0 && !strings.HasSuffix(p, "/") {
+		setEscapedPath(u, p+"/")
+	} else if len(p) == 0 && len(u.Host) > 0 {
+		u.Path = "/"
 	}
 }
 
-func removeDotSegments(u *url.URL) {
-	var dotFree []string
+func decodePercentEncodedDotSegments(u *url.URL) {
+	if len(u.RawPath) > 0 {
+		setEscapedPath(u, decodeEscapes(u.EscapedPath(), func(c byte) bool {
+			return c == '.' || c == '/'
+		}))
+	}
+}
 
+func removeDotSegments(u *url.URL) {
 	if len(u.Path) > 0 {
-		sections := strings.Split(u.Path, "/")
-		for _, s := range sections {
-			if s == ".." {
-				if len(dotFree) > 0 {
-					dotFree = dotFree[:len(dotFree)-1]
-				}
-			} else if s != "." {
-				dotFree = append(dotFree, s)
-			}
+		p := RemoveDotSegments(u.EscapedPath())
+		// Special case if the new path does not begin with /
+		if len(u.Host) > 0 && !strings.HasPrefix(p, "/") {
+			p = "/" + p
 		}
-		// Special case if host does not end with / and new path does not begin with /
-		u.Path = strings.Join(dotFree, "/")
-		if !strings.HasSuffix(u.Host, "/") && !strings.HasPrefix(u.Path, "/") {
-			u.Path = "/" + u.Path
+		setEscapedPath(u, p)
+	}
+}
+
+// RemoveDotSegments returns path with its "." and ".." segments
+// removed, as specified by the remove_dot_segments algorithm
+// of RFC 3986, section 5.2.4. Other segments, including empty
+// ones, are preserved, and ".." segments never go above the root.
+func RemoveDotSegments(path string) string {
+	var out []string
+	for in := path; len(in) > 0; {
+		switch {
+		case strings.HasPrefix(in, "../"):
+			in = in[3:]
+		case strings.HasPrefix(in, "./"):
+			in = in[2:]
+		case strings.HasPrefix(in, "/./"):
+			in = in[2:]
+		case in == "/.":
+			in = "/"
+		case strings.HasPrefix(in, "/../"):
+			in = in[3:]
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "/..":
+			in = "/"
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		case in == "." || in == "..":
+			in = ""
+		default:
+			// Move the first segment, with its leading slash if any,
+			// to the output.
+			i := strings.Index(in[1:], "/") + 1
+			if i == 0 {
+				i = len(in)
+			}
+			out = append(out, in[:i])
+			in = in[i:]
 		}
 	}
+	return strings.Join(out, "")
+}
+
+func normalizeWindowsDriveLetter(u *url.URL) {
+	if !strings.EqualFold(u.Scheme, "file") {
+		return
+	}
+	p := u.EscapedPath()
+	if m := rxDriveLetter.FindStringSubmatchIndex(p); m != nil {
+		setEscapedPath(u, "/"+strings.ToUpper(p[m[2]:m[3]])+":"+p[m[4]:])
+	}
+}
+
+func canonicalizeBlankPathWithQuery(u *url.URL) {
+	if len(u.Host) > 0 && len(u.Path) == 0 && len(u.Opaque) == 0 && len(u.RawQuery) > 0 {
+		u.Path = "/"
+		u.RawPath = ""
+	}
 }
 
 func removeDirectoryIndex(u *url.URL) {
-	if len(u.Path) > 0 {
-		u.Path = rxDirIndex.ReplaceAllString(u.Path, "$1")
+	if p := u.EscapedPath(); len(p) > 0 {
+		setEscapedPath(u, rxDirIndex.ReplaceAllString(p, "$1"))
 	}
 }
 
+// removeFragment removes the fragment of u, including that of
+// opaque URLs such as mailto:a@b#x.
 func removeFragment(u *url.URL) {
-	u.Fragment = ""
+	u.Fragment, u.RawFragment = "", ""
+}
+
+func removeFragmentDirectives(u *url.URL) {
+	frag := u.EscapedFragment()
+	if i := strings.Index(frag, ":~:"); i >= 0 {
+		setEscapedFragment(u, frag[:i])
+	}
 }
 
 func forceHttp(u *url.URL) {
@@ -175,10 +1064,77 @@ func forceHttp(u *url.URL) {
 	}
 }
 
+func forceWSS(u *url.URL) {
+	if strings.ToLower(u.Scheme) == "ws" {
+		changeScheme(u, "wss")
+	}
+}
+
+func forceHttpRemovingPort(u *url.URL) {
+	if strings.ToLower(u.Scheme) == "https" {
+		removeSchemeDefaultPort(u)
+		u.Scheme = "http"
+	}
+}
+
+func forceWSSRemovingPort(u *url.URL) {
+	if strings.ToLower(u.Scheme) == "ws" {
+		removeSchemeDefaultPort(u)
+		u.Scheme = "wss"
+	}
+}
+
+// removeSchemeDefaultPort removes the port of u if it is explicitly
+// set to the default port of its scheme.
+func removeSchemeDefaultPort(u *url.URL) {
+	port := strings.TrimLeft(u.Port(), "0")
+	if p, ok := defaultPort(strings.ToLower(u.Scheme)); ok && port == p {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+}
+
+// changeScheme sets the scheme of u, replacing an explicit port
+// equal to the default port of the old scheme by the default port
+// of the new one.
+func changeScheme(u *url.URL, scheme string) {
+	if port := strings.TrimLeft(u.Port(), "0"); len(port) > 0 {
+		oldPort, ok := defaultPort(strings.ToLower(u.Scheme))
+		newPort, newOK := defaultPort(scheme)
+		if ok && newOK && port == oldPort {
+			u.Host = u.Host[:strings.LastIndex(u.Host, ":")+1] + newPort
+		}
+	}
+	u.Scheme = scheme
+}
+
 func removeDuplicateSlashes(u *url.URL) {
 	if len(u.Path) > 0 {
-		u.Path = rxDupSlashes.ReplaceAllString(u.Path, "/")
+		setEscapedPath(u, rxDupSlashes.ReplaceAllString(u.EscapedPath(), "/"))
+	}
+}
+
+func sortMatrixParams(u *url.URL) {
+	if !strings.Contains(u.Path, ";") {
+		return
+	}
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, seg := range segments {
+		params := strings.Split(seg, ";")
+		if len(params) < 3 {
+			continue
+		}
+		sorted := params[1:]
+		sort.Strings(sorted)
+		j := 0
+		for k, p := range sorted {
+			if k == 0 || p != sorted[j-1] {
+				sorted[j] = p
+				j++
+			}
+		}
+		segments[i] = strings.Join(params[:j+1], ";")
 	}
+	setEscapedPath(u, strings.Join(segments, "/"))
 }
 
 func removeWWW(u *url.URL) {
@@ -193,9 +1149,73 @@ func addWWW(u *url.URL) {
 	}
 }
 
+func removeRedundantQuestionMarkAndAmpersand(u *url.URL) {
+	if strings.ContainsAny(u.RawQuery, "?&") {
+		u.RawQuery = strings.Join(strings.FieldsFunc(u.RawQuery, func(r rune) bool {
+			return r == '?' || r == '&'
+		}), "&")
+	}
+}
+
+func encodeQuerySpacesAsPlus(u *url.URL) {
+	q := u.RawQuery
+	if !strings.Contains(q, " ") && !strings.Contains(q, "%20") {
+		return
+	}
+	buf := make([]byte, 0, len(q))
+	for i := 0; i < len(q); i++ {
+		switch {
+		case q[i] == ' ':
+			buf = append(buf, '+')
+		case q[i] == '%' && strings.HasPrefix(q[i:], "%20"):
+			buf = append(buf, '+')
+			i += 2
+		case q[i] == '%' && i+2 < len(q):
+			// Skip the whole escape, so that %2520 is left alone.
+			buf = append(buf, q[i:i+3]...)
+			i += 2
+		default:
+			buf = append(buf, q[i])
+		}
+	}
+	u.RawQuery = string(buf)
+}
+
+func removeDuplicateQueryKeysKeepLast(u *url.URL) {
+	removeDuplicateQueryKeys(u, true)
+}
+
+func normalizeQuerySemicolonToAmpersand(u *url.URL) {
+	u.RawQuery = strings.Replace(u.RawQuery, ";", "&", -1)
+}
+
+func collapseConsecutiveAmpersands(u *url.URL) {
+	if len(u.RawQuery) > 0 {
+		u.RawQuery = rxDupAmpersands.ReplaceAllString(u.RawQuery, "&")
+	}
+}
+
+func removeTrailingQueryAmpersands(u *url.URL) {
+	u.RawQuery = strings.TrimRight(u.RawQuery, "&")
+}
+
+func removeEmptyQuerySeparator(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		u.ForceQuery = false
+	}
+}
+
 func sortQuery(u *url.URL) {
-	q := u.Query()
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		// url.ParseQuery drops the malformed parameters, such
+		// as those holding a semicolon, so keep them as they are.
+		sortRawQuery(u)
+		return
+	}
 	if len(q) == 0 {
+		// Only empty parameters, as in ?&.
+		u.RawQuery = ""
 		return
 	}
 	arKeys := make([]string, len(q))
@@ -212,10 +1232,10 @@ func sortQuery(u *url.URL) {
 			if buf.Len() > 0 {
 				buf.WriteRune('&')
 			}
-			buf.WriteString(fmt.Sprintf("%s=%s", k, url.QueryEscape(v)))
+			buf.WriteString(fmt.Sprintf("%s=%s", escapeSortedQueryKey(k), url.QueryEscape(v)))
 		}
 	}
 
 	// Rebuild the raw query string
 	u.RawQuery = buf.String()
-}
\ No newline at end of file
+}
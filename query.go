@@ -0,0 +1,515 @@
+package purell
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NormalizedQueryPairs normalizes the given URL string with f and
+// returns the unescaped key and value of each of its query parameters,
+// in order. Empty parameters, as in ?a=1&&b=2, are skipped.
+func NormalizedQueryPairs(rawurl string, f NormalizationFlags) ([][2]string, error) {
+	u, err := parse(rawurl, f)
+	if err != nil {
+		return nil, err
+	}
+	NormalizeURL(u, f)
+	var pairs [][2]string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if len(pair) > 0 {
+			pairs = append(pairs, [2]string{queryKey(pair), queryValue(pair)})
+		}
+	}
+	return pairs, nil
+}
+
+// sortRawQuery sorts the query parameters of u by key and then by
+// value, as sortQuery does, but without re-encoding them. Like
+// sortQuery, it drops empty parameters, as in ?a=1&&b=2.
+func sortRawQuery(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if len(pair) > 0 {
+			pairs = append(pairs, pair)
+		}
+	}
+	sortQueryPairs(pairs)
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+func canonicalizeQuery(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	var pairs []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if len(pair) == 0 {
+			continue
+		}
+		p := escapeQueryComponent(queryKey(pair))
+		if strings.Contains(pair, "=") {
+			p += "=" + escapeQueryComponent(queryValue(pair))
+		}
+		pairs = append(pairs, p)
+	}
+	sortQueryPairs(pairs)
+	kept := pairs[:0]
+	for i, p := range pairs {
+		if i == 0 || p != pairs[i-1] {
+			kept = append(kept, p)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
+
+// sortListParams sorts the comma-separated items of the values
+// of the query parameters with the given keys.
+func sortListParams(u *url.URL, keys []string) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	for i, pair := range pairs {
+		j := strings.Index(pair, "=")
+		if j < 0 || !containsString(keys, queryKey(pair)) {
+			continue
+		}
+		items := strings.Split(pair[j+1:], ",")
+		sort.SliceStable(items, func(i, j int) bool {
+			return unescapeQueryComponent(items[i]) < unescapeQueryComponent(items[j])
+		})
+		pairs[i] = pair[:j+1] + strings.Join(items, ",")
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+// trimQueryValues trims the white space around the values
+// of the query parameters with the given keys.
+func trimQueryValues(u *url.URL, keys []string) {
+	mapQueryValues(u, func(key, value string) string {
+		if !containsString(keys, key) {
+			return value
+		}
+		return trimQueryValue(value)
+	})
+}
+
+func trimQueryValueSpaces(u *url.URL) {
+	mapQueryValues(u, func(key, value string) string {
+		return trimQueryValue(value)
+	})
+}
+
+// trimQueryValue returns the raw query value v without its leading
+// and trailing white space, whether literal or encoded as %20 or +.
+func trimQueryValue(v string) string {
+	for {
+		t := strings.Trim(trimEscapedSpace(v), "+")
+		if t == v {
+			return v
+		}
+		v = t
+	}
+}
+
+// mapQueryValues replaces the raw value of each query parameter
+// of u that has one by the result of applying f to its unescaped
+// key and the value.
+func mapQueryValues(u *url.URL, f func(key, value string) string) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	for i, pair := range pairs {
+		if j := strings.Index(pair, "="); j >= 0 {
+			pairs[i] = pair[:j+1] + f(queryKey(pair), pair[j+1:])
+		}
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+func removeEmptyQueryPairs(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if len(pair) > 0 && pair != "=" {
+			kept = append(kept, pair)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
+
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// reencodeQuery decodes the keys and values of the query and
+// re-encodes them with escapeQueryComponentMinimal.
+func reencodeQuery(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	for i, pair := range pairs {
+		if len(pair) == 0 {
+			continue
+		}
+		p := escapeQueryComponentMinimal(queryKey(pair), true)
+		if strings.Contains(pair, "=") {
+			p += "=" + escapeQueryComponentMinimal(queryValue(pair), false)
+		}
+		pairs[i] = p
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+// escapeQueryComponentMinimal escapes s for use as a query key,
+// or value, escaping only what must be: the characters that are
+// not allowed in a query, and those that delimit its parameters.
+func escapeQueryComponentMinimal(s string, key bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) || strings.IndexByte("!$'()*,/:?@", c) >= 0 || c == '=' && !key {
+			buf = append(buf, c)
+			continue
+		}
+		buf = append(buf, '%', upperhex[c>>4], upperhex[c&15])
+	}
+	return string(buf)
+}
+
+// removeDuplicateQueryKeys removes the query parameters whose key
+// appears more than once, keeping either the first or the last one.
+func removeDuplicateQueryKeys(u *url.URL, keepLast bool) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	if keepLast {
+		reversePairs(pairs)
+	}
+	seen := make(map[string]bool)
+	kept := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if k := queryKey(pair); !seen[k] {
+			seen[k] = true
+			kept = append(kept, pair)
+		}
+	}
+	if keepLast {
+		reversePairs(kept)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
+
+func reversePairs(pairs []string) {
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+}
+
+// conflictingQueryKey returns the first key of the query that
+// appears more than once with different unescaped values.
+func conflictingQueryKey(query string) (string, bool) {
+	if len(query) == 0 {
+		return "", false
+	}
+	values := make(map[string]string)
+	for _, pair := range strings.Split(query, "&") {
+		k, v := queryKey(pair), queryValue(pair)
+		if prev, ok := values[k]; ok && prev != v {
+			return k, true
+		}
+		values[k] = v
+	}
+	return "", false
+}
+
+// sortQueryValues sorts the query parameters of u by value within
+// each key, keeping the keys in their order of first appearance.
+func sortQueryValues(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	var keys []string
+	groups := make(map[string][]string)
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		k := queryKey(pair)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], pair)
+	}
+	pairs := make([]string, 0, len(groups))
+	for _, k := range keys {
+		group := groups[k]
+		sort.SliceStable(group, func(i, j int) bool {
+			return queryValue(group[i]) < queryValue(group[j])
+		})
+		pairs = append(pairs, group...)
+	}
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+// trackingParams holds the keys of the tracking query parameters,
+// in lower case. Keys starting with utm_ are tracking ones too.
+var trackingParams = []string{
+	"dclid",
+	"fbclid",
+	"gclid",
+	"gclsrc",
+	"igshid",
+	"mc_cid",
+	"mc_eid",
+	"msclkid",
+	"yclid",
+	"_ga",
+	"_gl",
+}
+
+// TrackingParams returns the keys of the query parameters removed
+// by FlagRemoveTrackingParams, besides those starting with utm_.
+// Keys are compared case-insensitively.
+func TrackingParams() []string {
+	return append([]string(nil), trackingParams...)
+}
+
+// sessionIDParams holds the keys of the session identifier
+// parameters, in lower case.
+var sessionIDParams = []string{
+	"aspsessionid",
+	"cfid",
+	"cftoken",
+	"jsessionid",
+	"phpsessid",
+	"sessionid",
+	"sid",
+}
+
+// SessionIDParams returns the keys of the query and path parameters
+// removed by default by FlagRemoveSessionIDParams. Keys are compared
+// case-insensitively.
+func SessionIDParams() []string {
+	return append([]string(nil), sessionIDParams...)
+}
+
+func removeSessionIDParams(u *url.URL) {
+	removeParams(u, sessionIDParams)
+}
+
+// removeParams removes the query parameters and the path segment
+// parameters of u whose key is one of keys, compared
+// case-insensitively.
+func removeParams(u *url.URL, keys []string) {
+	isKey := func(k string) bool {
+		for _, key := range keys {
+			if strings.EqualFold(k, key) {
+				return true
+			}
+		}
+		return false
+	}
+	if p := u.EscapedPath(); strings.Contains(p, ";") {
+		segments := strings.Split(p, "/")
+		for i, seg := range segments {
+			params := strings.Split(seg, ";")
+			kept := params[:1]
+			for _, param := range params[1:] {
+				if !isKey(queryKey(param)) {
+					kept = append(kept, param)
+				}
+			}
+			segments[i] = strings.Join(kept, ";")
+		}
+		setEscapedPath(u, strings.Join(segments, "/"))
+	}
+	if len(u.RawQuery) > 0 {
+		var kept []string
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			if !isKey(queryKey(pair)) {
+				kept = append(kept, pair)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+}
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	return strings.HasPrefix(key, "utm_") || containsString(trackingParams, key)
+}
+
+func removeTrackingParams(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	var kept []string
+	for _, pair := range strings.Split(u.RawQuery, "&") {
+		if len(pair) > 0 && !isTrackingParam(queryKey(pair)) {
+			kept = append(kept, pair)
+		}
+	}
+	u.RawQuery = strings.Join(kept, "&")
+}
+
+var rxArrayIndex = regexp.MustCompile(`\[(\d+)\]`)
+
+func sortQueryArrayIndices(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ki, kj := arrayIndexSortKey(queryKey(pairs[i])), arrayIndexSortKey(queryKey(pairs[j]))
+		if ki != kj {
+			return ki < kj
+		}
+		return queryValue(pairs[i]) < queryValue(pairs[j])
+	})
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+// arrayIndexSortKey returns key with its numeric array indices
+// padded with zeros, so that they sort numerically.
+func arrayIndexSortKey(key string) string {
+	return rxArrayIndex.ReplaceAllStringFunc(key, func(index string) string {
+		digits := strings.TrimLeft(index[1:len(index)-1], "0")
+		if len(digits) < 20 {
+			digits = strings.Repeat("0", 20-len(digits)) + digits
+		}
+		return "[" + digits + "]"
+	})
+}
+
+func sortQueryNestedKeys(u *url.URL) {
+	if len(u.RawQuery) == 0 {
+		return
+	}
+	pairs := strings.Split(u.RawQuery, "&")
+	keys := make(map[string][]string, len(pairs))
+	for _, pair := range pairs {
+		k := queryKey(pair)
+		if _, ok := keys[k]; !ok {
+			keys[k] = nestedKeyPath(k)
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return lessNestedKeyPath(keys[queryKey(pairs[i])], keys[queryKey(pairs[j])])
+	})
+	u.RawQuery = strings.Join(pairs, "&")
+}
+
+// nestedKeyPath splits the nested query key k, such as a[b][0],
+// into its name and the contents of its brackets (a, b, 0). Keys
+// that are not well formed are not split.
+func nestedKeyPath(k string) []string {
+	i := strings.Index(k, "[")
+	if i <= 0 || !strings.HasSuffix(k, "]") {
+		return []string{k}
+	}
+	path := []string{k[:i]}
+	for _, seg := range strings.Split(k[i+1:len(k)-1], "][") {
+		if strings.ContainsAny(seg, "[]") {
+			return []string{k}
+		}
+		path = append(path, seg)
+	}
+	return path
+}
+
+// lessNestedKeyPath reports whether the nested key path p sorts
+// before q, comparing numeric segments numerically.
+func lessNestedKeyPath(p, q []string) bool {
+	for i := 0; i < len(p) && i < len(q); i++ {
+		a, b := p[i], q[i]
+		if i > 0 && isDigits(a) && isDigits(b) {
+			a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return len(p) < len(q)
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits.
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return len(s) > 0
+}
+
+// sortQueryPairs sorts the raw query parameter pairs by
+// unescaped key and then by unescaped value.
+func sortQueryPairs(pairs []string) {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ki, kj := queryKey(pairs[i]), queryKey(pairs[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return queryValue(pairs[i]) < queryValue(pairs[j])
+	})
+}
+
+// escapeSortedQueryKey escapes the query key k as url.QueryEscape
+// does for the values, encoding spaces as +, except that it leaves
+// the brackets of array keys such as a[1] as they are.
+func escapeSortedQueryKey(k string) string {
+	return bracketReplacer.Replace(url.QueryEscape(k))
+}
+
+var bracketReplacer = strings.NewReplacer("%5B", "[", "%5D", "]")
+
+// escapeQueryComponent escapes s for use as a query key or
+// value, encoding spaces as %20.
+func escapeQueryComponent(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// unescapeQueryComponent returns the unescaped form of the raw
+// query key or value s, or s itself if it is malformed.
+func unescapeQueryComponent(s string) string {
+	if t, err := url.QueryUnescape(s); err == nil {
+		return t
+	}
+	return s
+}
+
+// queryKey returns the unescaped key of the raw query
+// parameter pair.
+func queryKey(pair string) string {
+	key := pair
+	if i := strings.Index(key, "="); i >= 0 {
+		key = key[:i]
+	}
+	return unescapeQueryComponent(key)
+}
+
+// queryValue returns the unescaped value of the raw query
+// parameter pair.
+func queryValue(pair string) string {
+	i := strings.Index(pair, "=")
+	if i < 0 {
+		return ""
+	}
+	return unescapeQueryComponent(pair[i+1:])
+}
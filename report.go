@@ -0,0 +1,68 @@
+package purell
+
+import (
+	"strings"
+)
+
+// Report describes the changes made to a URL by
+// NormalizeURLStringReport.
+type Report struct {
+	// RemovedParams holds the unescaped keys of the query
+	// parameters that were removed, for example by
+	// FlagRemoveTrackingParams, in their order of appearance.
+	// A key appears as many times as it was removed.
+	RemovedParams []string
+
+	// FragmentRemoved reports whether the fragment was removed.
+	FragmentRemoved bool
+
+	// Changed reports whether the normalized URL differs
+	// from the original one.
+	Changed bool
+}
+
+// NormalizeURLStringReport is like NormalizeURLString but also
+// returns a report of the changes made to the URL, to audit
+// aggressive normalizations.
+func NormalizeURLStringReport(rawurl string, f NormalizationFlags) (string, Report, error) {
+	u, err := parse(rawurl, f)
+	if err != nil {
+		return "", Report{}, err
+	}
+	query, fragment := u.RawQuery, u.EscapedFragment()
+	NormalizeURL(u, f)
+	s := u.String()
+	return s, Report{
+		RemovedParams:   removedQueryKeys(query, u.RawQuery),
+		FragmentRemoved: len(fragment) > 0 && len(u.Fragment) == 0,
+		Changed:         s != rawurl,
+	}, nil
+}
+
+// removedQueryKeys returns the unescaped keys of the parameters
+// of the raw query before that are missing from the raw query after.
+func removedQueryKeys(before, after string) []string {
+	if len(before) == 0 {
+		return nil
+	}
+	left := make(map[string]int)
+	if len(after) > 0 {
+		for _, pair := range strings.Split(after, "&") {
+			if len(pair) > 0 {
+				left[queryKey(pair)]++
+			}
+		}
+	}
+	var removed []string
+	for _, pair := range strings.Split(before, "&") {
+		if len(pair) == 0 {
+			continue
+		}
+		if k := queryKey(pair); left[k] > 0 {
+			left[k]--
+		} else {
+			removed = append(removed, k)
+		}
+	}
+	return removed
+}
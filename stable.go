@@ -0,0 +1,79 @@
+package purell
+
+import (
+	"net/url"
+	"strings"
+)
+
+// StabilityError is the error returned by VerifyStable when
+// normalizing a URL a second time changes it again.
+type StabilityError struct {
+	// Normalized holds the URL normalized once.
+	Normalized string
+
+	// Renormalized holds the URL normalized twice.
+	Renormalized string
+
+	// Components holds the names of the components that
+	// differ between them, such as "host" or "query".
+	Components []string
+}
+
+func (e *StabilityError) Error() string {
+	return "normalization of " + e.Normalized + " is not stable: it normalizes to " + e.Renormalized + " (" + strings.Join(e.Components, ", ") + " changed)"
+}
+
+// VerifyStable checks that normalizing rawurl with f is idempotent:
+// the normalized URL, once parsed again, must normalize to itself.
+// It returns a *StabilityError describing the differing components
+// otherwise, or the error of NormalizeURLString if rawurl cannot be
+// normalized. It is meant to test custom combinations of flags.
+func VerifyStable(rawurl string, f NormalizationFlags) error {
+	first, err := NormalizeURLString(rawurl, f)
+	if err != nil {
+		return err
+	}
+	second, err := NormalizeURLString(first, f)
+	if err != nil {
+		return err
+	}
+	if first == second {
+		return nil
+	}
+	u1, err := url.Parse(first)
+	if err != nil {
+		return err
+	}
+	u2, err := url.Parse(second)
+	if err != nil {
+		return err
+	}
+	return &StabilityError{
+		Normalized:   first,
+		Renormalized: second,
+		Components:   differingComponents(u1, u2),
+	}
+}
+
+// differingComponents returns the names of the components
+// of u1 and u2 that differ, in their escaped forms.
+func differingComponents(u1, u2 *url.URL) []string {
+	var names []string
+	for _, c := range []struct {
+		name  string
+		equal bool
+	}{
+		{"scheme", u1.Scheme == u2.Scheme},
+		{"opaque", u1.Opaque == u2.Opaque},
+		{"userinfo", equalUserinfo(u1.User, u2.User)},
+		{"host", u1.Host == u2.Host},
+		{"path", u1.EscapedPath() == u2.EscapedPath()},
+		{"query", u1.RawQuery == u2.RawQuery && u1.ForceQuery == u2.ForceQuery},
+		{"fragment", u1.EscapedFragment() == u2.EscapedFragment()},
+	} {
+		if !c.equal {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}